@@ -17,17 +17,63 @@ limitations under the License
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
+// ContainerType is the kind of container in a pod spec
+type ContainerType string
+
+const (
+	// ContainerTypeContainer is a regular container in spec.containers
+	ContainerTypeContainer ContainerType = "Container"
+	// ContainerTypeInitContainer is an init container in spec.initContainers
+	ContainerTypeInitContainer ContainerType = "InitContainer"
+	// ContainerTypeEphemeralContainer is an ephemeral container in spec.ephemeralContainers
+	ContainerTypeEphemeralContainer ContainerType = "EphemeralContainer"
+)
+
 // Target is a target for image replacement
 type Target struct {
 	Name string           `json:"name"`
 	Type metav1.GroupKind `json:"type"`
 	// Container is the container that matches our list
-	Container string    `json:"container,omitempty"`
-	UID       types.UID `json:"uid,omitempty"`
+	Container string `json:"container,omitempty"`
+	// ContainerType is the kind of container that Container is
+	ContainerType ContainerType `json:"containerType,omitempty"`
+	UID           types.UID     `json:"uid,omitempty"`
+}
+
+// TagTransform describes how the tags of a repository differ from the tags of its equivalent repositories.
+// When switching away from the repository its Prefix and Suffix are removed from the tag. When switching
+// to the repository the tag is rewritten with Match and Replacement, then Prefix and Suffix are added.
+type TagTransform struct {
+	// Prefix is the prefix of every tag in this repository, e.g. v for v1.2.3
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+	// Suffix is the suffix of every tag in this repository, e.g. -mirror for 1.2.3-mirror
+	// +optional
+	Suffix string `json:"suffix,omitempty"`
+	// Match is a regular expression that is replaced with Replacement in the tag when switching to this repository
+	// +optional
+	Match string `json:"match,omitempty"`
+	// Replacement is the replacement for Match. Captured groups are expanded with $1 or ${1}
+	// +optional
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// RepositoryOptions holds the optional settings of one of the EquivalentRepositories
+type RepositoryOptions struct {
+	// Repository is the repository in EquivalentRepositories that these options apply to
+	Repository string `json:"repository"`
+	// TagTransform is applied to the tag when switching to or from this repository
+	// +optional
+	TagTransform *TagTransform `json:"tagTransform,omitempty"`
+	// ImagePullSecret is the name of an image pull secret that this repository needs. It is added to the pod
+	// template when switching to this repository, removed when switching away from it, and used to verify the image
+	// +optional
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
 }
 
 // ImageSourceReplacement is a single replacement
@@ -35,11 +81,201 @@ type ImageSourceReplacement struct {
 	// EquivalentRepositories is a list of possible replacement repositories
 	// they should each have the same set of tags available
 	EquivalentRepositories []string `json:"equivalentRepositories"`
+	// RepositoryOptions holds optional settings for some of the EquivalentRepositories
+	// +optional
+	RepositoryOptions []RepositoryOptions `json:"repositoryOptions,omitempty"`
+}
+
+// RegistryMirror is a set of registries or repository path prefixes that serve the same repositories
+type RegistryMirror struct {
+	// EquivalentRegistries is a list of registry hosts or path prefixes, such as docker.io/* or
+	// mirror.internal/dockerhub/*. Images below one of them can be switched to any of the others,
+	// keeping the rest of the repository path, the tag and the digest
+	EquivalentRegistries []string `json:"equivalentRegistries"`
+}
+
+// PatternSyntax is the syntax of a RepositoryPattern match expression
+type PatternSyntax string
+
+const (
+	// PatternSyntaxRegex matches with a regular expression
+	PatternSyntaxRegex PatternSyntax = "Regex"
+	// PatternSyntaxGlob matches with a glob, where * matches within a single path component
+	// and ** matches across path components
+	PatternSyntaxGlob PatternSyntax = "Glob"
+)
+
+// RepositoryPattern rewrites the repositories that match an expression
+type RepositoryPattern struct {
+	// Match is matched against the whole repository of an image, that is the registry and path
+	// without the tag or digest. Groups in a regular expression, and each wildcard in a glob, are captured
+	Match string `json:"match"`
+	// Syntax is the syntax of Match. Defaults to Regex
+	// +kubebuilder:validation:Enum=Regex;Glob
+	// +optional
+	Syntax PatternSyntax `json:"syntax,omitempty"`
+	// Replacements is a list of repositories to switch to, in order of preference.
+	// Captured groups are expanded with $1 or ${1}, and named regular expression groups with ${name}
+	Replacements []string `json:"replacements"`
+}
+
+// KeyReference selects a key in a Secret or ConfigMap in the namespace of the AlternateImageSource.
+// Exactly one of SecretKeyRef and ConfigMapKeyRef should be set
+type KeyReference struct {
+	// SecretKeyRef selects a key of a Secret
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+	// ConfigMapKeyRef selects a key of a ConfigMap
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+}
+
+// SignaturePolicy requires alternate images to carry a cosign signature
+type SignaturePolicy struct {
+	// PublicKey is the PEM encoded public key that the signature must verify against.
+	// Verification runs offline, without a transparency log
+	PublicKey KeyReference `json:"publicKey"`
+}
+
+// VerificationPolicy configures the checks that an alternate image must pass before it is switched to
+type VerificationPolicy struct {
+	// SkipManifestCheck disables checking that the tag or digest of the alternate image exists in its registry
+	// +optional
+	SkipManifestCheck bool `json:"skipManifestCheck,omitempty"`
+	// SkipPlatformCheck disables checking that the alternate image is available for the platforms
+	// of the nodes that the failing pods are scheduled to, or could be scheduled to
+	// +optional
+	SkipPlatformCheck bool `json:"skipPlatformCheck,omitempty"`
+	// Signature requires the alternate image to be signed. No signature is required when it is not set
+	// +optional
+	Signature *SignaturePolicy `json:"signature,omitempty"`
+}
+
+// PullFailureCause is the classified cause of an image pull failure
+// +kubebuilder:validation:Enum=ManifestUnknown;Unauthorized;RateLimited;Network;TLS;RegistryUnavailable;InvalidImageName;NeverPull;SlowPull;Unknown
+type PullFailureCause string
+
+const (
+	// PullFailureCauseManifestUnknown means the registry does not have the tag or digest, e.g. a mistyped tag
+	PullFailureCauseManifestUnknown PullFailureCause = "ManifestUnknown"
+	// PullFailureCauseUnauthorized means the registry refused the credentials, or needs some
+	PullFailureCauseUnauthorized PullFailureCause = "Unauthorized"
+	// PullFailureCauseRateLimited means the registry answered toomanyrequests
+	PullFailureCauseRateLimited PullFailureCause = "RateLimited"
+	// PullFailureCauseNetwork means the registry could not be resolved or reached, or timed out
+	PullFailureCauseNetwork PullFailureCause = "Network"
+	// PullFailureCauseTLS means the certificate of the registry could not be verified
+	PullFailureCauseTLS PullFailureCause = "TLS"
+	// PullFailureCauseRegistryUnavailable means the registry answered with a server error, or the kubelet
+	// reported it as RegistryUnavailable
+	PullFailureCauseRegistryUnavailable PullFailureCause = "RegistryUnavailable"
+	// PullFailureCauseInvalidImageName means the image reference cannot be parsed
+	PullFailureCauseInvalidImageName PullFailureCause = "InvalidImageName"
+	// PullFailureCauseNeverPull means the image is not present on the node and its pull policy is Never
+	PullFailureCauseNeverPull PullFailureCause = "NeverPull"
+	// PullFailureCauseSlowPull means the image has been pulling for longer than the slow pull threshold
+	PullFailureCauseSlowPull PullFailureCause = "SlowPull"
+	// PullFailureCauseUnknown means the message of the failure did not match a known cause, as for ImagePullBackOff
+	PullFailureCauseUnknown PullFailureCause = "Unknown"
+)
+
+// GitOpsPolicy is what is done when the target of a switch is managed by Argo CD or Flux, which revert changes
+// made in the cluster on their next sync
+type GitOpsPolicy string
+
+const (
+	// GitOpsPolicyRecord switches the target in place and records that the switch will be reverted
+	GitOpsPolicyRecord GitOpsPolicy = "Record"
+	// GitOpsPolicyPause pauses the sync of the target, then switches it in place
+	GitOpsPolicyPause GitOpsPolicy = "Pause"
+	// GitOpsPolicyPropose leaves the target alone and records a patch to make the switch in Git
+	GitOpsPolicyPropose GitOpsPolicy = "Propose"
+)
+
+// SwitchingPolicy configures how a target is switched
+type SwitchingPolicy struct {
+	// DeleteFailingPods deletes the pods of an OnDelete DaemonSet that are stuck in ImagePullBackOff after switching it,
+	// so they are recreated with the new image. Without it, the pods are only replaced when they are deleted by hand
+	// +optional
+	DeleteFailingPods bool `json:"deleteFailingPods,omitempty"`
+	// RecreateJobs replaces a Job with a copy that uses the new image, since the pod template of a Job cannot be
+	// changed. Without it, switches of standalone Jobs fail
+	// +optional
+	RecreateJobs bool `json:"recreateJobs,omitempty"`
+	// RolloutTimeout is how long the switched containers have to become ready before the switch is marked as
+	// failed and the next alternate image is tried. Defaults to 10m
+	// +optional
+	RolloutTimeout *metav1.Duration `json:"rolloutTimeout,omitempty"`
+	// GitOps is what is done when the target is managed by Argo CD or Flux. Defaults to Record
+	// +kubebuilder:validation:Enum=Record;Pause;Propose
+	// +optional
+	GitOps GitOpsPolicy `json:"gitOps,omitempty"`
+	// SlowPullThreshold is how long an image may be pulling before the pull is treated as failed, to switch away from
+	// a degraded registry. Slow pulls are not detected when it is not set
+	// +optional
+	SlowPullThreshold *metav1.Duration `json:"slowPullThreshold,omitempty"`
+	// Proactive switches containers that are waiting to start on an image from a registry that failed its latest
+	// health probe, before their pull fails. It needs the registry prober of the controller
+	// +optional
+	Proactive bool `json:"proactive,omitempty"`
+	// TriggerCauses are the causes of image pull failures that trigger a switch. Defaults to every cause except
+	// InvalidImageName and NeverPull, which an alternate image cannot fix
+	// +optional
+	TriggerCauses []PullFailureCause `json:"triggerCauses,omitempty"`
+	// MinFailingPods is how many pods of a target have to be failing on the same container before it is switched.
+	// Defaults to 1
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MinFailingPods int32 `json:"minFailingPods,omitempty"`
+	// MinFailingPercent is the share of the replicas of a target, from 0 to 100, that have to be failing on the same
+	// container before it is switched
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	MinFailingPercent int32 `json:"minFailingPercent,omitempty"`
+	// MinFailureDuration is how long a container of a target has to keep failing before the target is switched, so a
+	// brief outage does not trigger a switch
+	// +optional
+	MinFailureDuration *metav1.Duration `json:"minFailureDuration,omitempty"`
 }
 
 // AlternateImageSourceSpec defines the desired state of AlternateImageSource
 type AlternateImageSourceSpec struct {
-	ImageSourceReplacements []ImageSourceReplacement `json:"imageSourceReplacements"`
+	ImageSourceReplacements []ImageSourceReplacement `json:"imageSourceReplacements,omitempty"`
+	// RegistryMirrors is a list of registry level mirrors
+	RegistryMirrors []RegistryMirror `json:"registryMirrors,omitempty"`
+	// RepositoryPatterns is a list of pattern based repository rewrites
+	RepositoryPatterns []RepositoryPattern `json:"repositoryPatterns,omitempty"`
+	// Verification configures the checks run against an alternate image before switching to it
+	// +optional
+	Verification VerificationPolicy `json:"verification,omitempty"`
+	// Switching configures how targets are switched
+	// +optional
+	Switching SwitchingPolicy `json:"switching,omitempty"`
+}
+
+// SwitchPhase is the state of a switch
+type SwitchPhase string
+
+const (
+	// SwitchPhaseSwitched means the target was updated to NewImage, and its rollout is being followed
+	SwitchPhaseSwitched SwitchPhase = "Switched"
+	// SwitchPhaseSucceeded means NewImage was pulled and the switched container became ready
+	SwitchPhaseSucceeded SwitchPhase = "Succeeded"
+	// SwitchPhaseRefused means every alternate image was rejected, so the target was left alone
+	SwitchPhaseRefused SwitchPhase = "Refused"
+	// SwitchPhaseFailed means the target could not be updated, or NewImage did not roll out
+	SwitchPhaseFailed SwitchPhase = "Failed"
+	// SwitchPhaseProposed means the target is managed by GitOps, so it was left alone and ProposedPatch holds the
+	// switch to make in Git
+	SwitchPhaseProposed SwitchPhase = "Proposed"
+)
+
+// RejectedImage is an alternate image that was not switched to
+type RejectedImage struct {
+	Image string `json:"image"`
+	// Reason is why the image was rejected
+	Reason string `json:"reason"`
 }
 
 // SwitchStatus is a switch event
@@ -47,7 +283,72 @@ type SwitchStatus struct {
 	Time     metav1.Time `json:"time"`
 	OldImage string      `json:"oldImage"`
 	NewImage string      `json:"newImage"`
-	Target   Target      `json:"target"`
+	// OldDigestReference is the repository@digest form of OldImage when it is pinned to a digest
+	OldDigestReference string `json:"oldDigestReference,omitempty"`
+	// NewDigestReference is the repository@digest form of NewImage when it is pinned to a digest
+	NewDigestReference string `json:"newDigestReference,omitempty"`
+	// OldTag is the tag of OldImage when a tag transform changed it
+	OldTag string `json:"oldTag,omitempty"`
+	// NewTag is the tag of NewImage when a tag transform changed it
+	NewTag string `json:"newTag,omitempty"`
+	// OldImagePullSecret is the image pull secret of the repository of OldImage, removed by the switch
+	OldImagePullSecret string `json:"oldImagePullSecret,omitempty"`
+	// NewImagePullSecret is the image pull secret of the repository of NewImage, added by the switch
+	NewImagePullSecret string `json:"newImagePullSecret,omitempty"`
+	Target             Target `json:"target"`
+	// Cause is the classified cause of the image pull failure that triggered the switch
+	Cause PullFailureCause `json:"cause,omitempty"`
+	// FailureMessage is the message of the image pull failure that triggered the switch
+	FailureMessage string `json:"failureMessage,omitempty"`
+	// FailureCount is how many times the kubelet failed to pull OldImage, as reported by its Events
+	FailureCount int32 `json:"failureCount,omitempty"`
+	// OldJob is the Job run that the failing pod belonged to
+	OldJob string `json:"oldJob,omitempty"`
+	// NewJob is the Job that was created to replace OldJob
+	NewJob string `json:"newJob,omitempty"`
+	// GitOps is the Argo CD Application or Flux object that manages the target, e.g. Kustomization flux-system/apps
+	GitOps string `json:"gitOps,omitempty"`
+	// ProposedPatch is a strategic merge patch that makes the switch in the manifests of the target
+	ProposedPatch string `json:"proposedPatch,omitempty"`
+	// Phase is the state of the switch
+	Phase SwitchPhase `json:"phase,omitempty"`
+	// Rejected is each alternate image that was passed over, and why
+	Rejected []RejectedImage `json:"rejected,omitempty"`
+	// Message is a human readable explanation of the phase
+	Message string `json:"message,omitempty"`
+	// CompletionTime is when the rollout of the switch succeeded or failed
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// RegistryHealth is the result of the latest health probe of a registry
+type RegistryHealth struct {
+	// Registry is the registry host and port
+	Registry string `json:"registry"`
+	// Available is whether the registry answered the probe of its API and of its manifests
+	Available bool `json:"available"`
+	// Latency is the duration of the slowest request of the probe
+	Latency metav1.Duration `json:"latency,omitempty"`
+	// LastProbeTime is when the registry was last probed
+	LastProbeTime metav1.Time `json:"lastProbeTime"`
+	// Message explains why the registry is not available
+	Message string `json:"message,omitempty"`
+}
+
+// PendingSwitch is a failing container of a target that has not met the failure thresholds of the switching policy
+// yet
+type PendingSwitch struct {
+	Target Target `json:"target"`
+	// Image is the image the container is failing on
+	Image string           `json:"image"`
+	Cause PullFailureCause `json:"cause,omitempty"`
+	// FailingPods is how many pods of the target are failing on the container
+	FailingPods int32 `json:"failingPods"`
+	// Replicas is how many pods the target should have
+	Replicas int32 `json:"replicas"`
+	// FailingSince is when the container was first seen failing
+	FailingSince metav1.Time `json:"failingSince"`
+	// Message lists the thresholds that are not met yet
+	Message string `json:"message,omitempty"`
 }
 
 // AlternateImageSourceStatus defines the observed state of AlternateImageSource
@@ -56,8 +357,25 @@ type AlternateImageSourceStatus struct {
 	ObservedGeneration int64 `json:"observedGeneration"`
 	// Switches is each occurence of an image switch
 	Switches []SwitchStatus `json:"switches,omitempty"`
+	// Registries is the health of the registries of the AlternateImageSource, as probed by the controller
+	Registries []RegistryHealth `json:"registries,omitempty"`
+	// Pending is each failing container that will be switched once the failure thresholds are met
+	Pending []PendingSwitch `json:"pending,omitempty"`
+	// Conditions are the latest observations of the AlternateImageSource
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
+const (
+	// ConditionSignatureVerified reports whether the last alternate image that required a signature was verified
+	ConditionSignatureVerified = "SignatureVerified"
+	// ConditionRulesValid reports whether every replacement rule is valid. The invalid ones are skipped, and listed in
+	// its message
+	ConditionRulesValid = "RulesValid"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
@@ -21,6 +21,8 @@ limitations under the License
 package v1alpha1
 
 import (
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -93,6 +95,22 @@ func (in *AlternateImageSourceSpec) DeepCopyInto(out *AlternateImageSourceSpec)
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.RegistryMirrors != nil {
+		in, out := &in.RegistryMirrors, &out.RegistryMirrors
+		*out = make([]RegistryMirror, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RepositoryPatterns != nil {
+		in, out := &in.RepositoryPatterns, &out.RepositoryPatterns
+		*out = make([]RepositoryPattern, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.Verification.DeepCopyInto(&out.Verification)
+	in.Switching.DeepCopyInto(&out.Switching)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AlternateImageSourceSpec.
@@ -115,6 +133,27 @@ func (in *AlternateImageSourceStatus) DeepCopyInto(out *AlternateImageSourceStat
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Registries != nil {
+		in, out := &in.Registries, &out.Registries
+		*out = make([]RegistryHealth, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Pending != nil {
+		in, out := &in.Pending, &out.Pending
+		*out = make([]PendingSwitch, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AlternateImageSourceStatus.
@@ -135,6 +174,13 @@ func (in *ImageSourceReplacement) DeepCopyInto(out *ImageSourceReplacement) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.RepositoryOptions != nil {
+		in, out := &in.RepositoryOptions, &out.RepositoryOptions
+		*out = make([]RepositoryOptions, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageSourceReplacement.
@@ -147,11 +193,170 @@ func (in *ImageSourceReplacement) DeepCopy() *ImageSourceReplacement {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeyReference) DeepCopyInto(out *KeyReference) {
+	*out = *in
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeyReference.
+func (in *KeyReference) DeepCopy() *KeyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(KeyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PendingSwitch) DeepCopyInto(out *PendingSwitch) {
+	*out = *in
+	out.Target = in.Target
+	in.FailingSince.DeepCopyInto(&out.FailingSince)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PendingSwitch.
+func (in *PendingSwitch) DeepCopy() *PendingSwitch {
+	if in == nil {
+		return nil
+	}
+	out := new(PendingSwitch)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryHealth) DeepCopyInto(out *RegistryHealth) {
+	*out = *in
+	out.Latency = in.Latency
+	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryHealth.
+func (in *RegistryHealth) DeepCopy() *RegistryHealth {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryHealth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryMirror) DeepCopyInto(out *RegistryMirror) {
+	*out = *in
+	if in.EquivalentRegistries != nil {
+		in, out := &in.EquivalentRegistries, &out.EquivalentRegistries
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryMirror.
+func (in *RegistryMirror) DeepCopy() *RegistryMirror {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryMirror)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RejectedImage) DeepCopyInto(out *RejectedImage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RejectedImage.
+func (in *RejectedImage) DeepCopy() *RejectedImage {
+	if in == nil {
+		return nil
+	}
+	out := new(RejectedImage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RepositoryOptions) DeepCopyInto(out *RepositoryOptions) {
+	*out = *in
+	if in.TagTransform != nil {
+		in, out := &in.TagTransform, &out.TagTransform
+		*out = new(TagTransform)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RepositoryOptions.
+func (in *RepositoryOptions) DeepCopy() *RepositoryOptions {
+	if in == nil {
+		return nil
+	}
+	out := new(RepositoryOptions)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RepositoryPattern) DeepCopyInto(out *RepositoryPattern) {
+	*out = *in
+	if in.Replacements != nil {
+		in, out := &in.Replacements, &out.Replacements
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RepositoryPattern.
+func (in *RepositoryPattern) DeepCopy() *RepositoryPattern {
+	if in == nil {
+		return nil
+	}
+	out := new(RepositoryPattern)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SignaturePolicy) DeepCopyInto(out *SignaturePolicy) {
+	*out = *in
+	in.PublicKey.DeepCopyInto(&out.PublicKey)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SignaturePolicy.
+func (in *SignaturePolicy) DeepCopy() *SignaturePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SignaturePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SwitchStatus) DeepCopyInto(out *SwitchStatus) {
 	*out = *in
 	in.Time.DeepCopyInto(&out.Time)
 	out.Target = in.Target
+	if in.Rejected != nil {
+		in, out := &in.Rejected, &out.Rejected
+		*out = make([]RejectedImage, len(*in))
+		copy(*out, *in)
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SwitchStatus.
@@ -164,6 +369,56 @@ func (in *SwitchStatus) DeepCopy() *SwitchStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SwitchingPolicy) DeepCopyInto(out *SwitchingPolicy) {
+	*out = *in
+	if in.RolloutTimeout != nil {
+		in, out := &in.RolloutTimeout, &out.RolloutTimeout
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.SlowPullThreshold != nil {
+		in, out := &in.SlowPullThreshold, &out.SlowPullThreshold
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+	if in.TriggerCauses != nil {
+		in, out := &in.TriggerCauses, &out.TriggerCauses
+		*out = make([]PullFailureCause, len(*in))
+		copy(*out, *in)
+	}
+	if in.MinFailureDuration != nil {
+		in, out := &in.MinFailureDuration, &out.MinFailureDuration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SwitchingPolicy.
+func (in *SwitchingPolicy) DeepCopy() *SwitchingPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(SwitchingPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagTransform) DeepCopyInto(out *TagTransform) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagTransform.
+func (in *TagTransform) DeepCopy() *TagTransform {
+	if in == nil {
+		return nil
+	}
+	out := new(TagTransform)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Target) DeepCopyInto(out *Target) {
 	*out = *in
@@ -179,3 +434,23 @@ func (in *Target) DeepCopy() *Target {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VerificationPolicy) DeepCopyInto(out *VerificationPolicy) {
+	*out = *in
+	if in.Signature != nil {
+		in, out := &in.Signature, &out.Signature
+		*out = new(SignaturePolicy)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VerificationPolicy.
+func (in *VerificationPolicy) DeepCopy() *VerificationPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(VerificationPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
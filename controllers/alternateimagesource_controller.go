@@ -25,8 +25,8 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
-	"github.com/thoas/go-funk"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -34,8 +34,12 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
@@ -51,6 +55,21 @@ type AlternateImageSourceReconciler struct {
 	RestMapper       meta.RESTMapper
 	DynamicClient    dynamic.Interface
 	ControllerClient controller.Client
+	// PodTemplatePaths are the kinds of other workloads that can be switched, and where their pod template is
+	PodTemplatePaths PodTemplatePaths
+	// Registry is used to verify alternate images before switching to them. Verification is skipped when it is nil,
+	// except that alternates are refused when a signature is required
+	Registry *RegistryClient
+	// ArgoCDNamespace is the namespace of the Argo CD Applications that do not name their own namespace
+	ArgoCDNamespace string
+	// APIReader reads image pull secrets, service accounts and verification keys straight from the API server, so that
+	// secrets are neither watched nor cached. The Client is used when it is not set
+	APIReader client.Reader
+	// ProbeInterval is how often the registries of every AIS are probed. They are not probed when it is zero
+	ProbeInterval time.Duration
+
+	health *registryHealth
+	probed chan event.GenericEvent
 }
 
 type ControllerUtilsClientInstance struct {
@@ -59,8 +78,19 @@ type ControllerUtilsClientInstance struct {
 
 // +kubebuilder:rbac:groups=saffire.fairwinds.com,resources=alternateimagesources,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=saffire.fairwinds.com,resources=alternateimagesources/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;watch;list
-// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;update
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;watch;list;patch;delete
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;watch;list
+// +kubebuilder:rbac:groups=core,resources=events,verbs=get;watch;list
+// +kubebuilder:rbac:groups=core,resources=secrets;configmaps;serviceaccounts,verbs=get
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;patch
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;patch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;patch
+// +kubebuilder:rbac:groups=apps,resources=daemonsets,verbs=get;list;patch
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;patch
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;patch;create;delete
+// +kubebuilder:rbac:groups=argoproj.io,resources=applications,verbs=get;patch
+// +kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get
+// +kubebuilder:rbac:groups=helm.toolkit.fluxcd.io,resources=helmreleases,verbs=get;patch
 
 // Reconcile loads and reconciles the AlternateImageSource
 func (r *AlternateImageSourceReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
@@ -75,38 +105,83 @@ func (r *AlternateImageSourceReconciler) Reconcile(ctx context.Context, req reco
 	alternateImageSource.Status.ObservedGeneration = alternateImageSource.ObjectMeta.Generation
 	alternateImageSource.Status.Switches = pruneSwitchStatus(alternateImageSource.Status.Switches)
 
-	for _, replacement := range alternateImageSource.Spec.ImageSourceReplacements {
-		newSwitchStatus, err := r.needsActivation(req.Namespace, replacement.EquivalentRepositories)
+	if err := r.trackRollouts(&alternateImageSource); err != nil {
+		return ctrl.Result{}, err
+	}
+	alternateImageSource.Status.Registries = r.health.statusOf(req.NamespacedName)
+
+	rules, err := replacementRules(alternateImageSource.Spec)
+	rulesValid := v1.Condition{
+		Type:               saffirev1alpha1.ConditionRulesValid,
+		Status:             v1.ConditionTrue,
+		Reason:             "Valid",
+		ObservedGeneration: alternateImageSource.Generation,
+	}
+	if err != nil {
+		log.Error(err, "invalid replacement rules, continuing with the valid ones")
+		rulesValid.Status = v1.ConditionFalse
+		rulesValid.Reason = "InvalidRules"
+		rulesValid.Message = err.Error()
+	}
+	meta.SetStatusCondition(&alternateImageSource.Status.Conditions, rulesValid)
+
+	pending := []*saffirev1alpha1.SwitchStatus{}
+	belowThresholds := []saffirev1alpha1.PendingSwitch{}
+	var recheck time.Duration
+	for _, rule := range rules {
+		newSwitchStatuses, pendingSwitches, ruleRecheck, err := r.needsActivation(&alternateImageSource, rule)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
-		if newSwitchStatus == nil {
-			continue
-		}
+		recheck = sooner(recheck, ruleRecheck)
+		belowThresholds = appendPendingSwitches(belowThresholds, pendingSwitches)
 
-		if alternateImageSource.Status.Switches != nil {
-			if !r.shouldSwitch(alternateImageSource.Status.Switches, *newSwitchStatus) {
-				return ctrl.Result{}, nil
+		for _, newSwitchStatus := range newSwitchStatuses {
+			if hasSwitchFor(pending, newSwitchStatus.Target) {
+				continue
+			}
+			if alternateImageSource.Status.Switches != nil && !isFallback(alternateImageSource.Status.Switches, *newSwitchStatus) {
+				if !r.shouldSwitch(alternateImageSource.Status.Switches, *newSwitchStatus) {
+					continue
+				}
 			}
+
+			if newSwitchStatus.Phase == saffirev1alpha1.SwitchPhaseRefused {
+				log.Info("refusing switch", "image", newSwitchStatus.OldImage, "reason", newSwitchStatus.Message)
+			}
+			pending = append(pending, newSwitchStatus)
 		}
+	}
 
-		err = r.switchImage(newSwitchStatus, req.Namespace)
+	for _, switches := range groupByWorkload(pending) {
+		err = r.switchImage(&alternateImageSource, switches)
 		if err != nil {
 			log.Error(err, "unable to update target")
+			for _, switchStatus := range switches {
+				switchStatus.Phase = saffirev1alpha1.SwitchPhaseFailed
+				switchStatus.Message = err.Error()
+			}
 		}
-		alternateImageSource.Status.Switches = append(alternateImageSource.Status.Switches, *newSwitchStatus)
 	}
+	for _, switchStatus := range pending {
+		alternateImageSource.Status.Switches = append(alternateImageSource.Status.Switches, *switchStatus)
+	}
+	alternateImageSource.Status.Pending = belowThresholds
 
 	if err := r.Status().Update(ctx, &alternateImageSource); err != nil {
 		log.Error(err, "unable to update AlternateImageSource status")
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	if rolloutInProgress(alternateImageSource.Status.Switches) {
+		recheck = sooner(recheck, rolloutCheckInterval)
+	}
+	return ctrl.Result{RequeueAfter: recheck}, nil
 }
 
 // PodToAlternateImageSource is a handler.ToRequestsFunc to be used to enqueue requests to reconcile Pods
-// When a pod has an imagePullErr, this will request a reconciliation
+// When a pod has an imagePullErr, this will request a reconciliation. When a container of the pod is still being
+// created, this will request a reconciliation of the AIS that detect slow pulls or switch proactively
 func (r *AlternateImageSourceReconciler) PodToAlternateImageSource(o client.Object) []ctrl.Request {
 	result := []ctrl.Request{}
 	ctx := context.Background()
@@ -123,37 +198,53 @@ func (r *AlternateImageSourceReconciler) PodToAlternateImageSource(o client.Obje
 	}
 
 	if r.podHasImagePullErr(pod) {
-		result = r.requestAISInNamespace(p.Namespace)
+		result = r.requestAISInNamespace(p.Namespace, nil)
+	} else if podIsCreating(pod) {
+		result = r.requestAISInNamespace(p.Namespace, watchesCreatingPods)
 	}
 
 	return result
 }
 
 // SetupWithManager sets up the reconciler
+// When ProbeInterval is set, the registry prober is added to the manager as well, and each AIS is reconciled after
+// its registries were probed
 func (r *AlternateImageSourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	controllerBuilder := ctrl.NewControllerManagedBy(mgr).
 		For(&saffirev1alpha1.AlternateImageSource{}).
 		Watches(
 			&source.Kind{Type: &corev1.Pod{}},
 			handler.EnqueueRequestsFromMapFunc(r.PodToAlternateImageSource),
 		).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &corev1.Event{}},
+			handler.EnqueueRequestsFromMapFunc(r.EventToAlternateImageSource),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isPodPullEvent)),
+		)
+
+	if r.ProbeInterval > 0 && r.Registry != nil {
+		r.health = newRegistryHealth(probeMaxAge * r.ProbeInterval)
+		r.probed = make(chan event.GenericEvent)
+		if err := mgr.Add(manager.RunnableFunc(r.probeRegistries)); err != nil {
+			return err
+		}
+		controllerBuilder = controllerBuilder.Watches(&source.Channel{Source: r.probed}, &handler.EnqueueRequestForObject{})
+	}
+	return controllerBuilder.Complete(r)
 }
 
 func (r *AlternateImageSourceReconciler) podHasImagePullErr(pod *corev1.Pod) bool {
-	for _, status := range pod.Status.ContainerStatuses {
-		if status.State.Waiting == nil {
-			continue
-		}
-		if status.State.Waiting.Reason == "ErrImagePull" || status.State.Waiting.Reason == "ImagePullBackOff" {
+	for _, status := range podContainerStatuses(pod) {
+		if hasImagePullErr(status) {
 			return true
 		}
 	}
 	return false
 }
 
-// requestAISInNamespace requests reconciliation of any AlternateImageSources in a namespace
-func (r *AlternateImageSourceReconciler) requestAISInNamespace(namespace string) []ctrl.Request {
+// requestAISInNamespace requests a reconciliation of the AIS in a namespace that match filter, or of every AIS when
+// filter is nil
+func (r *AlternateImageSourceReconciler) requestAISInNamespace(namespace string, filter func(*saffirev1alpha1.AlternateImageSource) bool) []ctrl.Request {
 	log := r.Log.WithValues("requestAISInNamespace", namespace)
 	alternateImageSourcesInNamespace := saffirev1alpha1.AlternateImageSourceList{}
 	result := []ctrl.Request{}
@@ -162,67 +253,161 @@ func (r *AlternateImageSourceReconciler) requestAISInNamespace(namespace string)
 		log.Error(err, "error getting AlternateImageSources in namespace")
 		return nil
 	}
-	for _, ais := range alternateImageSourcesInNamespace.Items {
+	for idx, ais := range alternateImageSourcesInNamespace.Items {
+		if filter != nil && !filter(&alternateImageSourcesInNamespace.Items[idx]) {
+			continue
+		}
 		name := client.ObjectKey{Namespace: ais.Namespace, Name: ais.Name}
 		result = append(result, ctrl.Request{NamespacedName: name})
 	}
 	return result
 }
 
-// needsActivation finds the first pod and container in a namespace and returns them if they have an equivalent repository
-// and if they have image pull issues. Also returns the new image string
-func (r *AlternateImageSourceReconciler) needsActivation(namespace string, equivalentRepositories []string) (*saffirev1alpha1.SwitchStatus, error) {
+// needsActivation finds the containers with image pull issues in the namespace of the AlternateImageSource whose image is
+// matched by the replacement rule, and returns a switch for each of them with the new image string, or a refused switch
+// when every alternate image fails verification. Containers of the same workload that fail in several pods are
+// returned once, and only when they meet the failure thresholds of the switching policy. The others are returned as
+// pending switches, along with how long until they are checked again or a pull that is still under the slow pull
+// threshold reaches it
+func (r *AlternateImageSourceReconciler) needsActivation(ais *saffirev1alpha1.AlternateImageSource, rule replacementRule) ([]*saffirev1alpha1.SwitchStatus, []saffirev1alpha1.PendingSwitch, time.Duration, error) {
+	namespace := ais.Namespace
 	log := r.Log.WithValues("needsActivation", namespace)
 	var podsInNamespace corev1.PodList
 	if err := r.List(context.Background(), &podsInNamespace, client.InNamespace(namespace)); err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
 
-	for _, pod := range podsInNamespace.Items {
-		if r.podHasImagePullErr(&pod) {
-			log.Info("pod has image pull errors - checking for equivalentRepository")
-			for _, container := range pod.Spec.Containers {
-				repositoryName, _, err := parseImageString(container.Image)
-				if err != nil {
-					log.Error(err, "could not parse image string")
-					continue
+	pullEvents, err := r.podPullEvents(namespace)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	now := time.Now()
+	candidates := []*failingTarget{}
+	var recheck time.Duration
+	for idx := range podsInNamespace.Items {
+		pod := &podsInNamespace.Items[idx]
+		failing := failingContainers(pod, pullEvents[pod.UID])
+		if detectsSlowPulls(ais) {
+			slow, next := slowPullingContainers(pod, pullEvents[pod.UID], ais.Spec.Switching.SlowPullThreshold.Duration, now)
+			failing = append(failing, slow...)
+			recheck = sooner(recheck, next)
+		}
+		if ais.Spec.Switching.Proactive {
+			failing = append(failing, r.unavailableRegistryContainers(pod, pullEvents[pod.UID])...)
+		}
+		if len(failing) == 0 {
+			continue
+		}
+		log.Info("pod has image pull errors - checking for an alternate image")
+		var controller *unstructured.Unstructured
+		for _, container := range failing {
+			ref, err := parseImageReference(container.image)
+			if err != nil {
+				log.Error(err, "could not parse image string")
+				continue
+			}
+			if !rule.matches(ref) {
+				continue
+			}
+			if container.containerType == saffirev1alpha1.ContainerTypeEphemeralContainer {
+				log.Info("ephemeral containers cannot be changed once they are added to a pod", "container", container.name)
+				continue
+			}
+			if !triggersSwitch(ais, container.failure.cause) {
+				log.Info("image pull failure does not trigger a switch", "container", container.name, "cause", container.failure.cause)
+				continue
+			}
+			if controller == nil {
+				if controller = r.getPodController(pod); controller == nil {
+					break
 				}
-				if funk.ContainsString(equivalentRepositories, repositoryName) {
-					log.Info(fmt.Sprintf("container %s has equivalentRepositories for image %s", container.Name, container.Image))
-					newImageString, err := getNewImage(container.Image, equivalentRepositories)
-					if err != nil {
-						return nil, err
-					}
-
-					controller := r.getPodController(&pod)
-
-					switchStatus := &saffirev1alpha1.SwitchStatus{
-						Time: v1.Now(),
-						Target: saffirev1alpha1.Target{
-							Name:      controller.GetName(),
-							Container: container.Name,
-							Type: v1.GroupKind{
-								Kind:  controller.GetKind(),
-								Group: controller.GetAPIVersion(),
-							},
-						},
-						OldImage: container.Image,
-						NewImage: newImageString,
-					}
-
-					return switchStatus, nil
+			}
+			target := saffirev1alpha1.Target{
+				Name:          controller.GetName(),
+				Container:     container.name,
+				ContainerType: container.containerType,
+				Type: v1.GroupKind{
+					Kind:  controller.GetKind(),
+					Group: controller.GetAPIVersion(),
+				},
+			}
+			if wasSwitchedAway(ais.Status.Switches, target, container.image) {
+				continue
+			}
+			if candidate := failingTargetFor(candidates, target); candidate != nil {
+				if candidate.lastPod != pod.Name {
+					candidate.pods++
+					candidate.lastPod = pod.Name
 				}
+				continue
 			}
+			candidates = append(candidates, &failingTarget{
+				target:    target,
+				pod:       pod,
+				container: container,
+				pods:      1,
+				replicas:  replicasOf(controller),
+				lastPod:   pod.Name,
+			})
+		}
+	}
+
+	switches := []*saffirev1alpha1.SwitchStatus{}
+	pending := []saffirev1alpha1.PendingSwitch{}
+	for _, candidate := range candidates {
+		pendingSwitch, next, met := checkThresholds(ais, candidate, now)
+		if !met {
+			log.Info("failure thresholds are not met yet", "target", candidate.target.Name, "container", candidate.target.Container, "progress", pendingSwitch.Message)
+			pending = append(pending, pendingSwitch)
+			recheck = sooner(recheck, next)
+			continue
+		}
+
+		container := candidate.container
+		ref, _ := parseImageReference(container.image)
+		log.Info(fmt.Sprintf("container %s has alternate images for image %s", container.name, container.image))
+		newImageString, rejected, err := r.selectAlternate(ais, candidate.pod, container.image, rule, triedImages(ais.Status.Switches, candidate.target))
+		if err != nil {
+			return nil, nil, 0, err
 		}
+		oldTag, newTag := tagChange(container.image, newImageString)
+
+		switchStatus := &saffirev1alpha1.SwitchStatus{
+			Time:               v1.Now(),
+			Target:             candidate.target,
+			OldImage:           container.image,
+			NewImage:           newImageString,
+			OldDigestReference: ref.digestReference(),
+			NewDigestReference: digestReference(newImageString),
+			OldTag:             oldTag,
+			NewTag:             newTag,
+			OldImagePullSecret: rule.pullSecret(ref),
+			NewImagePullSecret: pullSecretFor(newImageString, rule),
+			Cause:              container.failure.cause,
+			FailureMessage:     container.failure.message,
+			FailureCount:       container.failure.count,
+			OldJob:             ownerName(candidate.pod, "Job"),
+			Phase:              saffirev1alpha1.SwitchPhaseSwitched,
+			Rejected:           rejected,
+		}
+		if newImageString == "" {
+			switchStatus.Phase = saffirev1alpha1.SwitchPhaseRefused
+			switchStatus.Message = "every alternate image was rejected"
+		}
+		switches = append(switches, switchStatus)
 	}
-	return nil, nil
+	return switches, pending, recheck, nil
 }
 
 // getPodController determines the top-level controller of a pod
 func (r *AlternateImageSourceReconciler) getPodController(pod *corev1.Pod) *unstructured.Unstructured {
-	log := r.Log.WithValues("getPodController", pod.Name)
+	return r.topControllerOf(pod, make(map[string]unstructured.Unstructured))
+}
 
-	cache := make(map[string]unstructured.Unstructured)
+// topControllerOf determines the top-level controller of a pod, keeping the controllers it reads in cache
+func (r *AlternateImageSourceReconciler) topControllerOf(pod *corev1.Pod, cache map[string]unstructured.Unstructured) *unstructured.Unstructured {
+	log := r.Log.WithValues("getPodController", pod.Name)
 
 	podData, err := json.Marshal(pod)
 	if err != nil {
@@ -240,6 +425,9 @@ func (r *AlternateImageSourceReconciler) getPodController(pod *corev1.Pod) *unst
 	unstructuredPod := unstructured.Unstructured{
 		Object: placeholder,
 	}
+	// Typed objects from the client have no kind, which a pod without owners is returned with
+	unstructuredPod.SetAPIVersion("v1")
+	unstructuredPod.SetKind("Pod")
 
 	controller, err := r.ControllerClient.GetTopController(unstructuredPod, cache)
 	if err != nil {
@@ -250,34 +438,89 @@ func (r *AlternateImageSourceReconciler) getPodController(pod *corev1.Pod) *unst
 	return &controller
 }
 
-// switch image executes the switch for different controller types
-func (r *AlternateImageSourceReconciler) switchImage(switchStatus *saffirev1alpha1.SwitchStatus, namespace string) error {
+// switchImage executes the switches of a single target for different controller types, writing them in one update
+func (r *AlternateImageSourceReconciler) switchImage(ais *saffirev1alpha1.AlternateImageSource, switches []*saffirev1alpha1.SwitchStatus) error {
 	ctx := context.Background()
+	namespace := ais.Namespace
+	target := switches[0].Target
+	for _, switchStatus := range switches {
+		r.Log.Info("switching", "container", switchStatus.Target.Container, "old", switchStatus.OldImage, "new", switchStatus.NewImage)
+	}
 
-	switch strings.ToLower(switchStatus.Target.Type.Kind) {
+	gvk, err := targetGroupKind(target)
+	if err != nil {
+		return err
+	}
+	owner, err := r.targetGitOpsOwner(gvk, namespace, target.Name)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		proposed, err := r.applyGitOpsPolicy(ais, gvk, owner, switches)
+		if err != nil || proposed {
+			return err
+		}
+	}
+	if path, ok := r.PodTemplatePaths[gvk.GroupKind()]; ok {
+		return r.updateTemplatedObject(gvk, namespace, path, switches)
+	}
+
+	switch strings.ToLower(target.Type.Kind) {
 	case "deployment":
 		deployment := &appsv1.Deployment{}
-		err := r.Get(ctx, client.ObjectKey{Name: switchStatus.Target.Name, Namespace: namespace}, deployment)
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, deployment)
 		if err != nil {
 			return err
 		}
-
-		for _, container := range deployment.Spec.Template.Spec.Containers {
-			if container.Name == switchStatus.Target.Container {
-
-				r.Log.Info("switching", "old", switchStatus.OldImage, "new", switchStatus.NewImage)
-				err = r.updateDeployment(deployment, switchStatus.OldImage, switchStatus.NewImage)
-				if err != nil {
-					r.Log.Error(err, "")
-					continue
-				}
-			}
+		return r.updateDeployment(deployment, switches)
+	case "replicaset":
+		replicaSet := &appsv1.ReplicaSet{}
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, replicaSet)
+		if err != nil {
+			return err
+		}
+		return r.updateReplicaSet(replicaSet, switches)
+	case "pod":
+		pod := &corev1.Pod{}
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, pod)
+		if err != nil {
+			return err
+		}
+		return r.updatePod(pod, switches)
+	case "statefulset":
+		statefulSet := &appsv1.StatefulSet{}
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, statefulSet)
+		if err != nil {
+			return err
+		}
+		return r.updateStatefulSet(statefulSet, switches)
+	case "daemonset":
+		daemonSet := &appsv1.DaemonSet{}
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, daemonSet)
+		if err != nil {
+			return err
+		}
+		return r.updateDaemonSet(daemonSet, switches, ais.Spec.Switching.DeleteFailingPods)
+	case "cronjob":
+		cronJob := &batchv1.CronJob{}
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, cronJob)
+		if err != nil {
+			return err
 		}
+		return r.updateCronJob(cronJob, switches)
+	case "job":
+		job := &batchv1.Job{}
+		err := r.Get(ctx, client.ObjectKey{Name: target.Name, Namespace: namespace}, job)
+		if err != nil {
+			return err
+		}
+		if !ais.Spec.Switching.RecreateJobs {
+			return errors.New("the pod template of a Job cannot be changed, set switching.recreateJobs to recreate it")
+		}
+		return r.recreateJob(job, switches)
 	default:
-		r.Log.Info("controller type not implemented yet", "type", switchStatus.Target.Type.Kind)
+		return errors.Errorf("controller type %s is not supported", target.Type.Kind)
 	}
-
-	return nil
 }
 
 // shouldSwitch determines if a switch is possible within time constraints
@@ -342,23 +585,7 @@ func pruneSwitchStatus(statuses []saffirev1alpha1.SwitchStatus) []saffirev1alpha
 	return returnList
 }
 
-func (r *AlternateImageSourceReconciler) updateDeployment(deployment *appsv1.Deployment, old string, new string) error {
-	replacedAny := false
-	for idx, container := range deployment.Spec.Template.Spec.Containers {
-		existingImage := container.Image
-		if strings.Contains(existingImage, old) {
-			newImage := strings.Replace(existingImage, old, new, 1)
-			deployment.Spec.Template.Spec.Containers[idx].Image = newImage
-			replacedAny = true
-		}
-	}
-
-	if replacedAny {
-		ctx := context.Background()
-		err := r.Update(ctx, deployment)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+func (r *AlternateImageSourceReconciler) updateDeployment(deployment *appsv1.Deployment, switches []*saffirev1alpha1.SwitchStatus) error {
+	_, err := r.patchPodSpec(deployment, templatePodSpecPath, func() *corev1.PodSpec { return &deployment.Spec.Template.Spec }, switchChange(switches))
+	return err
 }
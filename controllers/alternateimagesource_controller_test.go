@@ -0,0 +1,130 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func TestAlternateImageSourceReconciler_Reconcile_ephemeralContainers(t *testing.T) {
+	const image = "quay.io/fairwinds/docker-demo:v1"
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+	ais.Spec.ImageSourceReplacements = []saffirev1alpha1.ImageSourceReplacement{{
+		EquivalentRepositories: []string{"quay.io/fairwinds/docker-demo", "ghcr.io/fairwinds/docker-demo"},
+	}}
+	ready := corev1.ContainerStatus{Ready: true, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	pod := appPod("web-abc-1", "nginx:1.23", ready)
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: image},
+	}}
+	pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "debug",
+		Image: image,
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+			Reason:  "ImagePullBackOff",
+			Message: `Back-off pulling image "` + image + `"`,
+		}},
+	}}
+	r := newDeploymentReconciler(t, ais, "nginx:1.23", pod)
+
+	for i := 0; i < 2; i++ {
+		result, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ais)})
+		assert.NoError(t, err)
+		assert.Zero(t, result.RequeueAfter)
+	}
+
+	updated := &saffirev1alpha1.AlternateImageSource{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(ais), updated))
+	assert.Empty(t, updated.Status.Switches)
+	assert.Empty(t, updated.Status.Pending)
+}
+
+func TestAlternateImageSourceReconciler_Reconcile_thresholds(t *testing.T) {
+	const image = "quay.io/fairwinds/docker-demo:v1"
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+	ais.Spec.ImageSourceReplacements = []saffirev1alpha1.ImageSourceReplacement{{
+		EquivalentRepositories: []string{"quay.io/fairwinds/docker-demo", "ghcr.io/fairwinds/docker-demo"},
+	}}
+	ais.Spec.Switching.MinFailingPods = 2
+	ready := corev1.ContainerStatus{Ready: true, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	backOff := corev1.ContainerStatus{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+		Reason:  "ImagePullBackOff",
+		Message: `Back-off pulling image "` + image + `"`,
+	}}}
+	r := newDeploymentReconciler(t, ais, image, appPod("web-abc-1", image, ready), appPod("web-abc-2", image, backOff))
+
+	result, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ais)})
+	assert.NoError(t, err)
+	assert.Equal(t, thresholdCheckInterval, result.RequeueAfter)
+
+	updated := &saffirev1alpha1.AlternateImageSource{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(ais), updated))
+	assert.Empty(t, updated.Status.Switches)
+	if assert.Len(t, updated.Status.Pending, 1) {
+		pending := updated.Status.Pending[0]
+		assert.Equal(t, "web", pending.Target.Name)
+		assert.Equal(t, image, pending.Image)
+		assert.Equal(t, int32(1), pending.FailingPods)
+		assert.Equal(t, int32(2), pending.Replicas)
+		assert.Equal(t, "thresholds not met: 1 of 2 failing pods", pending.Message)
+	}
+
+	deployment := &appsv1.Deployment{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web"}, deployment))
+	assert.Equal(t, image, deployment.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestAlternateImageSourceReconciler_Reconcile_invalidRules(t *testing.T) {
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+	ais.Spec.RepositoryPatterns = []saffirev1alpha1.RepositoryPattern{
+		{Match: "quay.io/(.*)", Replacements: []string{"ghcr.io/$1"}},
+		{Match: "quay.io/(.*", Replacements: []string{"ghcr.io/$1"}},
+	}
+	r := newFakeReconciler(ais)
+	request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ais)}
+
+	_, err := r.Reconcile(context.Background(), request)
+	assert.NoError(t, err)
+	updated := &saffirev1alpha1.AlternateImageSource{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(ais), updated))
+	condition := meta.FindStatusCondition(updated.Status.Conditions, saffirev1alpha1.ConditionRulesValid)
+	if assert.NotNil(t, condition) {
+		assert.Equal(t, metav1.ConditionFalse, condition.Status)
+		assert.Equal(t, "InvalidRules", condition.Reason)
+		assert.Contains(t, condition.Message, "quay.io/(.*")
+	}
+
+	updated.Spec.RepositoryPatterns = updated.Spec.RepositoryPatterns[:1]
+	assert.NoError(t, r.Update(context.Background(), updated))
+	_, err = r.Reconcile(context.Background(), request)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(ais), updated))
+	condition = meta.FindStatusCondition(updated.Status.Conditions, saffirev1alpha1.ConditionRulesValid)
+	if assert.NotNil(t, condition) {
+		assert.Equal(t, metav1.ConditionTrue, condition.Status)
+		assert.Empty(t, condition.Message)
+	}
+}
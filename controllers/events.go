@@ -0,0 +1,245 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// pullEventFreshness is how long ago the kubelet may have last reported an image pull for its Event to be used
+const pullEventFreshness = 5 * time.Minute
+
+var (
+	// containerFieldPath matches the field path of the container that an Event of a pod is about
+	containerFieldPath = regexp.MustCompile(`^spec\.(containers|initContainers|ephemeralContainers)\{(.+)\}$`)
+	// failedPullMessage matches the message of a Failed Event, with the image and the error of the registry
+	failedPullMessage = regexp.MustCompile(`(?s)^Failed to pull image "([^"]+)": (.*)$`)
+	// backOffPullMessage matches the message of a BackOff Event
+	backOffPullMessage = regexp.MustCompile(`^Back-off pulling image "([^"]+)"`)
+	// pulledMessage matches the messages of a Pulled Event
+	pulledMessage = regexp.MustCompile(`^(?:Successfully pulled image|Container image) "([^"]+)"`)
+	// pullingMessage matches the message of a Pulling Event
+	pullingMessage = regexp.MustCompile(`^Pulling image "([^"]+)"`)
+)
+
+// pullEventReasons are the reasons of the Events that the kubelet reports image pulls with
+var pullEventReasons = map[string]bool{"Failed": true, "BackOff": true, "Pulling": true, "Pulled": true}
+
+// PodEventSelector limits the Events that are cached to those about pods, since no other Event is read
+var PodEventSelector = cache.ObjectSelector{Field: fields.OneTermEqualSelector("involvedObject.kind", "Pod")}
+
+// containerFieldTypes maps the fields of a pod spec to the type of their containers
+var containerFieldTypes = map[string]saffirev1alpha1.ContainerType{
+	"containers":          saffirev1alpha1.ContainerTypeContainer,
+	"initContainers":      saffirev1alpha1.ContainerTypeInitContainer,
+	"ephemeralContainers": saffirev1alpha1.ContainerTypeEphemeralContainer,
+}
+
+// pullEvent is an image pull of a container reported by the kubelet in an Event
+type pullEvent struct {
+	// podUID is the UID of the pod, so that a pod recreated with the same name does not inherit the Events of the
+	// previous one
+	podUID    types.UID
+	container podContainer
+	// reason is the reason of the Event, Failed, BackOff, Pulling or Pulled
+	reason string
+	// message is the error of the registry, only set for Failed Events
+	message  string
+	count    int32
+	lastSeen time.Time
+}
+
+// parsePullEvent reads an image pull from an Event, and reports whether the Event is about one
+func parsePullEvent(event *corev1.Event) (pullEvent, bool) {
+	if event.InvolvedObject.Kind != "Pod" {
+		return pullEvent{}, false
+	}
+	fields := containerFieldPath.FindStringSubmatch(event.InvolvedObject.FieldPath)
+	if fields == nil {
+		return pullEvent{}, false
+	}
+	pull := pullEvent{
+		podUID:    event.InvolvedObject.UID,
+		container: podContainer{name: fields[2], containerType: containerFieldTypes[fields[1]]},
+		reason:    event.Reason,
+		count:     eventCount(event),
+		lastSeen:  eventTime(event),
+	}
+
+	var matches []string
+	switch event.Reason {
+	case "Failed":
+		matches = failedPullMessage.FindStringSubmatch(event.Message)
+		if matches != nil {
+			pull.message = matches[2]
+		}
+	case "BackOff":
+		matches = backOffPullMessage.FindStringSubmatch(event.Message)
+		// A back-off is not a pull, so it is not counted
+		pull.count = 0
+	case "Pulled":
+		matches = pulledMessage.FindStringSubmatch(event.Message)
+	case "Pulling":
+		matches = pullingMessage.FindStringSubmatch(event.Message)
+	}
+	if matches == nil {
+		return pullEvent{}, false
+	}
+	pull.container.image = matches[1]
+	return pull, true
+}
+
+// isPodPullEvent reports whether an object is an Event that may be about an image pull of a pod, to filter the Events
+// that are watched
+func isPodPullEvent(o client.Object) bool {
+	event, ok := o.(*corev1.Event)
+	return ok && event.InvolvedObject.Kind == "Pod" && pullEventReasons[event.Reason]
+}
+
+// failed reports whether the Event is about an image that failed to be pulled
+func (e pullEvent) failed() bool {
+	return e.reason == "Failed" || e.reason == "BackOff"
+}
+
+// eventCount returns how many times an Event occurred
+func eventCount(event *corev1.Event) int32 {
+	if event.Series != nil {
+		return event.Series.Count
+	}
+	if event.Count == 0 {
+		return 1
+	}
+	return event.Count
+}
+
+// eventTime returns when an Event last occurred
+func eventTime(event *corev1.Event) time.Time {
+	switch {
+	case event.Series != nil:
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.CreationTimestamp.Time
+	}
+}
+
+// reportedPullFailure returns the image pull failure of a container that its Events report, and whether they report
+// one that is more recent than the last time the image was pulled. The failed pulls of every Event are counted
+func reportedPullFailure(events []pullEvent, container podContainer) (pullFailure, bool) {
+	var latestFailure, latestMessage, latestPull *pullEvent
+	var count int32
+	for idx, event := range events {
+		if event.container != container || event.reason == "Pulling" {
+			continue
+		}
+		if !event.failed() {
+			if latestPull == nil || event.lastSeen.After(latestPull.lastSeen) {
+				latestPull = &events[idx]
+			}
+			continue
+		}
+		count += event.count
+		if latestFailure == nil || event.lastSeen.After(latestFailure.lastSeen) {
+			latestFailure = &events[idx]
+		}
+		if event.message != "" && (latestMessage == nil || event.lastSeen.After(latestMessage.lastSeen)) {
+			latestMessage = &events[idx]
+		}
+	}
+	if latestFailure == nil || (latestPull != nil && latestPull.lastSeen.After(latestFailure.lastSeen)) {
+		return pullFailure{}, false
+	}
+
+	failure := pullFailure{reason: "Failed", cause: saffirev1alpha1.PullFailureCauseUnknown, count: count}
+	if latestMessage != nil {
+		failure.message = latestMessage.message
+		failure.cause = classifyPullMessage(latestMessage.message, container.image)
+	}
+	return failure, true
+}
+
+// pullStart returns when the kubelet last started pulling the image of a container, and whether the pull has not
+// finished or failed since
+func pullStart(events []pullEvent, container podContainer) (time.Time, bool) {
+	var started, finished time.Time
+	for _, event := range events {
+		if event.container != container {
+			continue
+		}
+		if event.reason == "Pulling" {
+			if event.lastSeen.After(started) {
+				started = event.lastSeen
+			}
+		} else if event.lastSeen.After(finished) {
+			finished = event.lastSeen
+		}
+	}
+	return started, !started.IsZero() && !finished.After(started)
+}
+
+// podPullEvents returns the image pulls reported by the Events of the pods in a namespace, by pod UID. Failures that
+// were not reported recently are left out
+func (r *AlternateImageSourceReconciler) podPullEvents(namespace string) (map[types.UID][]pullEvent, error) {
+	var events corev1.EventList
+	if err := r.List(context.Background(), &events, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	pulls := map[types.UID][]pullEvent{}
+	for idx := range events.Items {
+		pull, ok := parsePullEvent(&events.Items[idx])
+		if !ok || (pull.failed() && time.Since(pull.lastSeen) > pullEventFreshness) {
+			continue
+		}
+		pulls[pull.podUID] = append(pulls[pull.podUID], pull)
+	}
+	return pulls, nil
+}
+
+// EventToAlternateImageSource is a handler.ToRequestsFunc to be used to enqueue requests to reconcile Events
+// When the kubelet reports that it failed to pull an image, this will request a reconciliation. When it starts to
+// pull an image, this will request a reconciliation of the AIS that detect slow pulls or switch proactively
+func (r *AlternateImageSourceReconciler) EventToAlternateImageSource(o client.Object) []ctrl.Request {
+	event, ok := o.(*corev1.Event)
+	if !ok {
+		r.Log.Error(errors.Errorf("expected an Event but got a %T", o), "failed to get AlternateImageSource for Event")
+		return nil
+	}
+	pull, ok := parsePullEvent(event)
+	switch {
+	case !ok:
+		return nil
+	case pull.failed():
+		return r.requestAISInNamespace(event.Namespace, nil)
+	case pull.reason == "Pulling":
+		return r.requestAISInNamespace(event.Namespace, watchesCreatingPods)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_parsePullEvent(t *testing.T) {
+	seen := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	app := podContainer{name: "app", image: "quay.io/fairwinds/saffire:v1", containerType: saffirev1alpha1.ContainerTypeContainer}
+	tests := []struct {
+		name      string
+		kind      string
+		fieldPath string
+		reason    string
+		message   string
+		count     int32
+		want      pullEvent
+		wantOk    bool
+	}{
+		{
+			name:      "failed pull",
+			kind:      "Pod",
+			fieldPath: "spec.containers{app}",
+			reason:    "Failed",
+			message:   `Failed to pull image "quay.io/fairwinds/saffire:v1": rpc error: code = Unknown desc = 502 Bad Gateway`,
+			count:     3,
+			want:      pullEvent{podUID: "uid-1", container: app, reason: "Failed", message: "rpc error: code = Unknown desc = 502 Bad Gateway", count: 3, lastSeen: seen},
+			wantOk:    true,
+		},
+		{
+			name:      "back-off is not counted",
+			kind:      "Pod",
+			fieldPath: "spec.containers{app}",
+			reason:    "BackOff",
+			message:   `Back-off pulling image "quay.io/fairwinds/saffire:v1"`,
+			count:     12,
+			want:      pullEvent{podUID: "uid-1", container: app, reason: "BackOff", lastSeen: seen},
+			wantOk:    true,
+		},
+		{
+			name:      "pulled init container",
+			kind:      "Pod",
+			fieldPath: "spec.initContainers{wait}",
+			reason:    "Pulled",
+			message:   `Container image "busybox:1.36" already present on machine`,
+			count:     1,
+			want: pullEvent{
+				podUID:    "uid-1",
+				container: podContainer{name: "wait", image: "busybox:1.36", containerType: saffirev1alpha1.ContainerTypeInitContainer},
+				reason:    "Pulled",
+				count:     1,
+				lastSeen:  seen,
+			},
+			wantOk: true,
+		},
+		{
+			name:      "failed to start",
+			kind:      "Pod",
+			fieldPath: "spec.containers{app}",
+			reason:    "Failed",
+			message:   "Error: ErrImagePull",
+			wantOk:    false,
+		},
+		{
+			name:    "not a container",
+			kind:    "Pod",
+			reason:  "BackOff",
+			message: `Back-off pulling image "quay.io/fairwinds/saffire:v1"`,
+			wantOk:  false,
+		},
+		{
+			name:      "not a pod",
+			kind:      "Deployment",
+			fieldPath: "spec.containers{app}",
+			reason:    "Failed",
+			message:   `Failed to pull image "quay.io/fairwinds/saffire:v1": not found`,
+			wantOk:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &corev1.Event{
+				InvolvedObject: corev1.ObjectReference{Kind: tt.kind, Name: "web-1", UID: "uid-1", FieldPath: tt.fieldPath},
+				Reason:         tt.reason,
+				Message:        tt.message,
+				Count:          tt.count,
+				LastTimestamp:  metav1.NewTime(seen),
+			}
+			got, ok := parsePullEvent(event)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_failingContainers_events(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	app := podContainer{name: "app", image: "quay.io/fairwinds/saffire:v1", containerType: saffirev1alpha1.ContainerTypeContainer}
+	failed := pullEvent{container: app, reason: "Failed", message: "toomanyrequests: rate limit exceeded", count: 4, lastSeen: now.Add(-time.Minute)}
+	backOff := pullEvent{container: app, reason: "BackOff", lastSeen: now}
+	pulled := pullEvent{container: app, reason: "Pulled", count: 1, lastSeen: now.Add(time.Minute)}
+	tests := []struct {
+		name    string
+		waiting *corev1.ContainerStateWaiting
+		running bool
+		events  []pullEvent
+		want    []failingContainer
+	}{
+		{
+			name:    "back-off gets the message of the failed pull",
+			waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: `Back-off pulling image "quay.io/fairwinds/saffire:v1"`},
+			events:  []pullEvent{failed, backOff},
+			want: []failingContainer{{
+				podContainer: app,
+				failure:      pullFailure{reason: "ImagePullBackOff", message: "toomanyrequests: rate limit exceeded", cause: saffirev1alpha1.PullFailureCauseRateLimited, count: 4},
+			}},
+		},
+		{
+			name:    "reported before the status",
+			waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+			events:  []pullEvent{failed},
+			want: []failingContainer{{
+				podContainer: app,
+				failure:      pullFailure{reason: "Failed", message: "toomanyrequests: rate limit exceeded", cause: saffirev1alpha1.PullFailureCauseRateLimited, count: 4},
+			}},
+		},
+		{
+			name:    "pulled since",
+			waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+			events:  []pullEvent{failed, backOff, pulled},
+			want:    []failingContainer{},
+		},
+		{
+			name:    "running",
+			running: true,
+			events:  []pullEvent{failed},
+			want:    []failingContainer{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := corev1.ContainerState{Waiting: tt.waiting}
+			if tt.running {
+				state.Running = &corev1.ContainerStateRunning{}
+			}
+			pod := &corev1.Pod{
+				Spec:   corev1.PodSpec{Containers: []corev1.Container{{Name: app.name, Image: app.image}}},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{Name: app.name, State: state}}},
+			}
+			assert.Equal(t, tt.want, failingContainers(pod, tt.events))
+		})
+	}
+}
+
+func TestAlternateImageSourceReconciler_podPullEvents(t *testing.T) {
+	event := func(name string, uid types.UID, reason string, message string) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Namespace: "default", Name: name},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "db-0", UID: uid, FieldPath: "spec.containers{db}"},
+			Reason:         reason,
+			Message:        message,
+			Count:          1,
+			LastTimestamp:  metav1.Now(),
+		}
+	}
+	r := newFakeReconciler(
+		event("db-0.1", "old", "Failed", `Failed to pull image "postgres:15": toomanyrequests: rate limit exceeded`),
+		event("db-0.2", "new", "Pulling", `Pulling image "postgres:15"`),
+	)
+
+	pulls, err := r.podPullEvents("default")
+	assert.NoError(t, err)
+	assert.Len(t, pulls["old"], 1)
+	assert.Len(t, pulls["new"], 1)
+	assert.Equal(t, "Pulling", pulls["new"][0].reason)
+}
+
+func Test_isPodPullEvent(t *testing.T) {
+	assert.True(t, isPodPullEvent(&corev1.Event{InvolvedObject: corev1.ObjectReference{Kind: "Pod"}, Reason: "BackOff"}))
+	assert.False(t, isPodPullEvent(&corev1.Event{InvolvedObject: corev1.ObjectReference{Kind: "Pod"}, Reason: "Scheduled"}))
+	assert.False(t, isPodPullEvent(&corev1.Event{InvolvedObject: corev1.ObjectReference{Kind: "Deployment"}, Reason: "Failed"}))
+	assert.False(t, isPodPullEvent(&corev1.Pod{}))
+}
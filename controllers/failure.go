@@ -0,0 +1,220 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// pullFailure is the classified image pull failure that a container is waiting on
+type pullFailure struct {
+	reason  string
+	message string
+	cause   saffirev1alpha1.PullFailureCause
+	// count is how many times the image failed to be pulled, when Events report it
+	count int32
+}
+
+// pullFailureReasons maps the waiting reasons of image pull failures to their cause. The causes of ErrImagePull and
+// ImagePullBackOff are read from the message
+var pullFailureReasons = map[string]saffirev1alpha1.PullFailureCause{
+	"ErrImagePull":        "",
+	"ImagePullBackOff":    "",
+	"InvalidImageName":    saffirev1alpha1.PullFailureCauseInvalidImageName,
+	"ErrImageNeverPull":   saffirev1alpha1.PullFailureCauseNeverPull,
+	"RegistryUnavailable": saffirev1alpha1.PullFailureCauseRegistryUnavailable,
+}
+
+// pullFailureMessages are the lower case fragments of the messages of each cause, in the order they are checked.
+// Rate limits and authorization come first, since registries often wrap them in not found or server errors, and
+// server errors before network errors, since a gateway timeout is answered by the registry
+var pullFailureMessages = []struct {
+	cause     saffirev1alpha1.PullFailureCause
+	fragments []string
+}{
+	{saffirev1alpha1.PullFailureCauseRateLimited, []string{"toomanyrequests", "too many requests", "rate limit"}},
+	{saffirev1alpha1.PullFailureCauseUnauthorized, []string{"unauthorized", "authentication required", "access denied", "denied:", "forbidden", "insufficient_scope"}},
+	{saffirev1alpha1.PullFailureCauseTLS, []string{"x509:", "tls:", "certificate", "server gave http response to https client"}},
+	{saffirev1alpha1.PullFailureCauseRegistryUnavailable, []string{"service unavailable", "bad gateway", "gateway timeout", "internal server error"}},
+	{saffirev1alpha1.PullFailureCauseNetwork, []string{"no such host", "i/o timeout", "connection refused", "connection reset", "network is unreachable", "no route to host", "deadline exceeded", "timeout"}},
+	{saffirev1alpha1.PullFailureCauseManifestUnknown, []string{"manifest unknown", "not found", "code = notfound"}},
+}
+
+// defaultTriggerCauses are the causes that trigger a switch when an AIS does not choose them
+var defaultTriggerCauses = []saffirev1alpha1.PullFailureCause{
+	saffirev1alpha1.PullFailureCauseManifestUnknown,
+	saffirev1alpha1.PullFailureCauseUnauthorized,
+	saffirev1alpha1.PullFailureCauseRateLimited,
+	saffirev1alpha1.PullFailureCauseNetwork,
+	saffirev1alpha1.PullFailureCauseTLS,
+	saffirev1alpha1.PullFailureCauseRegistryUnavailable,
+	saffirev1alpha1.PullFailureCauseSlowPull,
+	saffirev1alpha1.PullFailureCauseUnknown,
+}
+
+// pullFailureOf classifies the image pull failure that a container running image is waiting on, and reports whether it
+// is waiting on one
+func pullFailureOf(status corev1.ContainerStatus, image string) (pullFailure, bool) {
+	if status.State.Waiting == nil {
+		return pullFailure{}, false
+	}
+	reason := status.State.Waiting.Reason
+	cause, ok := pullFailureReasons[reason]
+	if !ok {
+		return pullFailure{}, false
+	}
+	message := status.State.Waiting.Message
+	if cause == "" {
+		cause = classifyPullMessage(message, image)
+	}
+	return pullFailure{reason: reason, message: message, cause: cause}, true
+}
+
+// quotedPattern matches the quoted image references and URLs of kubelet messages
+var quotedPattern = regexp.MustCompile(`"[^"]*"`)
+
+// classifyPullMessage returns the cause of an image pull failure of an image from its message
+func classifyPullMessage(message string, image string) saffirev1alpha1.PullFailureCause {
+	message = withoutImage(strings.ToLower(message), strings.ToLower(image))
+	for _, candidate := range pullFailureMessages {
+		for _, fragment := range candidate.fragments {
+			if strings.Contains(message, fragment) {
+				return candidate.cause
+			}
+		}
+	}
+	return saffirev1alpha1.PullFailureCauseUnknown
+}
+
+// withoutImage removes the quoted strings and the mentions of an image from a lower case pull failure message, so
+// that the fragments of the causes are not found in the name of the image, such as timeout in acme/timeout-worker
+func withoutImage(message string, image string) string {
+	message = quotedPattern.ReplaceAllString(message, `""`)
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return message
+	}
+	normalized := ref.normalized()
+	mentions := []string{
+		image,
+		normalized.String(),
+		normalized.repository(),
+		"/v2/" + ref.path + "/",
+		"/v2/" + normalized.path + "/",
+	}
+	for _, mention := range mentions {
+		message = strings.ReplaceAll(message, mention, " ")
+	}
+	return message
+}
+
+// triggersSwitch reports whether an image pull failure with the cause triggers a switch for an AIS
+func triggersSwitch(ais *saffirev1alpha1.AlternateImageSource, cause saffirev1alpha1.PullFailureCause) bool {
+	causes := ais.Spec.Switching.TriggerCauses
+	if len(causes) == 0 {
+		causes = defaultTriggerCauses
+	}
+	for _, triggerCause := range causes {
+		if triggerCause == cause {
+			return true
+		}
+	}
+	return false
+}
+
+// detectsSlowPulls reports whether an AIS switches images that are slow to pull
+func detectsSlowPulls(ais *saffirev1alpha1.AlternateImageSource) bool {
+	return ais.Spec.Switching.SlowPullThreshold != nil && ais.Spec.Switching.SlowPullThreshold.Duration > 0
+}
+
+// watchesCreatingPods reports whether an AIS switches containers that are still being created, because it detects
+// slow pulls or switches proactively
+func watchesCreatingPods(ais *saffirev1alpha1.AlternateImageSource) bool {
+	return detectsSlowPulls(ais) || ais.Spec.Switching.Proactive
+}
+
+// podIsCreating reports whether a container of a pod is waiting to be created, which includes pulling its image
+func podIsCreating(pod *corev1.Pod) bool {
+	for _, status := range podContainerStatuses(pod) {
+		if isCreating(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCreating reports whether a container is waiting to be created, as opposed to waiting after a failure
+func isCreating(status corev1.ContainerStatus) bool {
+	return status.State.Waiting != nil && (status.State.Waiting.Reason == "ContainerCreating" || status.State.Waiting.Reason == "PodInitializing")
+}
+
+// slowPullingContainers returns the containers of a pod that have been pulling their image for longer than threshold,
+// and how long until the next of the others reaches it. A pull starts with the latest Pulling Event of the container.
+// Without any Event, a container that is still being created is taken to be pulling since the pod started
+func slowPullingContainers(pod *corev1.Pod, events []pullEvent, threshold time.Duration, now time.Time) ([]failingContainer, time.Duration) {
+	slow := []failingContainer{}
+	var next time.Duration
+	for _, container := range podContainers(&pod.Spec) {
+		status, ok := containerStatusOf(pod, container)
+		if !ok || status.State.Waiting == nil {
+			continue
+		}
+		started, pulling := pullStart(events, container)
+		if !pulling && !hasEventsFor(events, container) && status.State.Waiting.Reason == "ContainerCreating" && pod.Status.StartTime != nil {
+			started, pulling = pod.Status.StartTime.Time, true
+		}
+		if !pulling {
+			continue
+		}
+		elapsed := now.Sub(started)
+		if elapsed < threshold {
+			next = sooner(next, threshold-elapsed)
+			continue
+		}
+		slow = append(slow, failingContainer{container, pullFailure{
+			reason:  "SlowPull",
+			message: fmt.Sprintf("image has been pulling for %s", elapsed.Round(time.Second)),
+			cause:   saffirev1alpha1.PullFailureCauseSlowPull,
+		}})
+	}
+	return slow, next
+}
+
+// hasPulled reports whether an Event reports that the image of a container was pulled
+func hasPulled(events []pullEvent, container podContainer) bool {
+	for _, event := range events {
+		if event.container == container && event.reason == "Pulled" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEventsFor reports whether any Event is about the image of a container
+func hasEventsFor(events []pullEvent, container podContainer) bool {
+	for _, event := range events {
+		if event.container == container {
+			return true
+		}
+	}
+	return false
+}
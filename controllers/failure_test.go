@@ -0,0 +1,254 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_pullFailureOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		reason  string
+		message string
+		image   string
+		want    saffirev1alpha1.PullFailureCause
+		wantOk  bool
+	}{
+		{
+			name:    "manifest unknown",
+			reason:  "ErrImagePull",
+			message: `rpc error: code = NotFound desc = failed to pull and unpack image "docker.io/library/nginx:1.255": failed to resolve reference "docker.io/library/nginx:1.255": docker.io/library/nginx:1.255: not found`,
+			want:    saffirev1alpha1.PullFailureCauseManifestUnknown,
+			wantOk:  true,
+		},
+		{
+			name:    "unauthorized",
+			reason:  "ErrImagePull",
+			message: `rpc error: code = Unknown desc = failed to pull and unpack image "quay.io/private/app:v1": failed to resolve reference "quay.io/private/app:v1": unexpected status from HEAD request to https://quay.io/v2/private/app/manifests/v1: 401 UNAUTHORIZED`,
+			want:    saffirev1alpha1.PullFailureCauseUnauthorized,
+			wantOk:  true,
+		},
+		{
+			name:    "rate limited",
+			reason:  "ErrImagePull",
+			message: "toomanyrequests: You have reached your pull rate limit. You may increase the limit by authenticating and upgrading",
+			want:    saffirev1alpha1.PullFailureCauseRateLimited,
+			wantOk:  true,
+		},
+		{
+			name:    "dns",
+			reason:  "ErrImagePull",
+			message: `failed to do request: Head "https://registry.internal/v2/app/manifests/v1": dial tcp: lookup registry.internal: no such host`,
+			want:    saffirev1alpha1.PullFailureCauseNetwork,
+			wantOk:  true,
+		},
+		{
+			name:    "timeout",
+			reason:  "ErrImagePull",
+			message: `failed to do request: Head "https://registry.internal/v2/app/manifests/v1": dial tcp 10.0.0.1:443: i/o timeout`,
+			want:    saffirev1alpha1.PullFailureCauseNetwork,
+			wantOk:  true,
+		},
+		{
+			name:    "tls",
+			reason:  "ErrImagePull",
+			message: `failed to do request: Head "https://registry.internal/v2/app/manifests/v1": tls: failed to verify certificate: x509: certificate signed by unknown authority`,
+			want:    saffirev1alpha1.PullFailureCauseTLS,
+			wantOk:  true,
+		},
+		{
+			name:    "server error",
+			reason:  "ErrImagePull",
+			message: "unexpected status from HEAD request: 503 Service Unavailable",
+			want:    saffirev1alpha1.PullFailureCauseRegistryUnavailable,
+			wantOk:  true,
+		},
+		{
+			name:    "manifest unknown of an image named like a network error",
+			reason:  "ErrImagePull",
+			message: `rpc error: code = NotFound desc = failed to pull and unpack image "docker.io/acme/timeout-worker:v2x": failed to resolve reference "docker.io/acme/timeout-worker:v2x": docker.io/acme/timeout-worker:v2x: not found`,
+			image:   "acme/timeout-worker:v2x",
+			want:    saffirev1alpha1.PullFailureCauseManifestUnknown,
+			wantOk:  true,
+		},
+		{
+			name:    "manifest unknown of an image named like an authorization error",
+			reason:  "ErrImagePull",
+			message: `rpc error: code = Unknown desc = failed to pull and unpack image "registry.internal/forbidden-fruit:v1": failed to resolve reference "registry.internal/forbidden-fruit:v1": unexpected status from HEAD request to https://registry.internal/v2/forbidden-fruit/manifests/v1: 404 Not Found`,
+			image:   "registry.internal/forbidden-fruit:v1",
+			want:    saffirev1alpha1.PullFailureCauseManifestUnknown,
+			wantOk:  true,
+		},
+		{
+			name:    "back-off of an image named like a tls error",
+			reason:  "ImagePullBackOff",
+			message: `Back-off pulling image "quay.io/acme/certificate-sync:v1"`,
+			image:   "quay.io/acme/certificate-sync:v1",
+			want:    saffirev1alpha1.PullFailureCauseUnknown,
+			wantOk:  true,
+		},
+		{
+			name:    "back-off has no cause",
+			reason:  "ImagePullBackOff",
+			message: `Back-off pulling image "nginx:1.25"`,
+			want:    saffirev1alpha1.PullFailureCauseUnknown,
+			wantOk:  true,
+		},
+		{
+			name:    "invalid image name",
+			reason:  "InvalidImageName",
+			message: `Failed to apply default image tag "Nginx": couldn't parse image reference "Nginx"`,
+			want:    saffirev1alpha1.PullFailureCauseInvalidImageName,
+			wantOk:  true,
+		},
+		{
+			name:    "never pull",
+			reason:  "ErrImageNeverPull",
+			message: `Container image "nginx:1.25" is not present with pull policy of Never`,
+			want:    saffirev1alpha1.PullFailureCauseNeverPull,
+			wantOk:  true,
+		},
+		{
+			name:   "registry unavailable",
+			reason: "RegistryUnavailable",
+			want:   saffirev1alpha1.PullFailureCauseRegistryUnavailable,
+			wantOk: true,
+		},
+		{
+			name:   "not a pull failure",
+			reason: "CrashLoopBackOff",
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := corev1.ContainerStatus{
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: tt.reason, Message: tt.message}},
+			}
+			got, ok := pullFailureOf(status, tt.image)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got.cause)
+		})
+	}
+}
+
+func Test_triggersSwitch(t *testing.T) {
+	tests := []struct {
+		name   string
+		causes []saffirev1alpha1.PullFailureCause
+		cause  saffirev1alpha1.PullFailureCause
+		want   bool
+	}{
+		{
+			name:  "default triggers on network errors",
+			cause: saffirev1alpha1.PullFailureCauseNetwork,
+			want:  true,
+		},
+		{
+			name:  "default ignores invalid image names",
+			cause: saffirev1alpha1.PullFailureCauseInvalidImageName,
+			want:  false,
+		},
+		{
+			name:   "chosen causes",
+			causes: []saffirev1alpha1.PullFailureCause{saffirev1alpha1.PullFailureCauseRateLimited},
+			cause:  saffirev1alpha1.PullFailureCauseRateLimited,
+			want:   true,
+		},
+		{
+			name:   "cause that was not chosen",
+			causes: []saffirev1alpha1.PullFailureCause{saffirev1alpha1.PullFailureCauseRateLimited},
+			cause:  saffirev1alpha1.PullFailureCauseManifestUnknown,
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ais := &saffirev1alpha1.AlternateImageSource{}
+			ais.Spec.Switching.TriggerCauses = tt.causes
+			assert.Equal(t, tt.want, triggersSwitch(ais, tt.cause))
+		})
+	}
+}
+
+func Test_slowPullingContainers(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	app := podContainer{name: "app", image: "quay.io/fairwinds/saffire:v1", containerType: saffirev1alpha1.ContainerTypeContainer}
+	pulling := pullEvent{container: app, reason: "Pulling", count: 1, lastSeen: now.Add(-3 * time.Minute)}
+	tests := []struct {
+		name      string
+		reason    string
+		startTime *metav1.Time
+		events    []pullEvent
+		wantSlow  bool
+		wantNext  time.Duration
+	}{
+		{
+			name:     "pulling for longer than the threshold",
+			reason:   "ContainerCreating",
+			events:   []pullEvent{pulling},
+			wantSlow: true,
+		},
+		{
+			name:     "pulling for less than the threshold",
+			reason:   "ContainerCreating",
+			events:   []pullEvent{{container: app, reason: "Pulling", count: 1, lastSeen: now.Add(-30 * time.Second)}},
+			wantNext: 90 * time.Second,
+		},
+		{
+			name:   "pulled",
+			reason: "ContainerCreating",
+			events: []pullEvent{pulling, {container: app, reason: "Pulled", count: 1, lastSeen: now.Add(-time.Minute)}},
+		},
+		{
+			name:      "pod age without events",
+			reason:    "ContainerCreating",
+			startTime: &metav1.Time{Time: now.Add(-5 * time.Minute)},
+			wantSlow:  true,
+		},
+		{
+			name:      "waiting on init containers",
+			reason:    "PodInitializing",
+			startTime: &metav1.Time{Time: now.Add(-5 * time.Minute)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: app.name, Image: app.image}}},
+				Status: corev1.PodStatus{
+					StartTime: tt.startTime,
+					ContainerStatuses: []corev1.ContainerStatus{
+						{Name: app.name, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: tt.reason}}},
+					},
+				},
+			}
+			slow, next := slowPullingContainers(pod, tt.events, 2*time.Minute, now)
+			assert.Equal(t, tt.wantSlow, len(slow) == 1)
+			if tt.wantSlow {
+				assert.Equal(t, saffirev1alpha1.PullFailureCauseSlowPull, slow[0].failure.cause)
+			}
+			assert.Equal(t, tt.wantNext, next)
+		})
+	}
+}
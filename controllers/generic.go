@@ -0,0 +1,132 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// PodTemplatePaths maps the kinds of workloads that embed a pod template to the fields that lead to the template
+type PodTemplatePaths map[schema.GroupKind][]string
+
+// fieldPattern matches a single field of a pod template path
+var fieldPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ParsePodTemplatePaths parses a comma separated list of Kind.group=path entries, such as
+// Rollout.argoproj.io={.spec.template}. Paths are JSONPath expressions made only of field names.
+func ParsePodTemplatePaths(value string) (PodTemplatePaths, error) {
+	paths := PodTemplatePaths{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("pod template path %q is not of the form Kind.group=path", entry)
+		}
+		groupKind := schema.ParseGroupKind(strings.TrimSpace(parts[0]))
+		if groupKind.Kind == "" {
+			return nil, fmt.Errorf("pod template path %q does not name a kind", entry)
+		}
+		fields, err := parseFieldPath(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("pod template path %q: %w", entry, err)
+		}
+		paths[groupKind] = fields
+	}
+	return paths, nil
+}
+
+// parseFieldPath splits a JSONPath expression such as {.spec.template} into its fields
+func parseFieldPath(path string) ([]string, error) {
+	path = strings.TrimSpace(path)
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "{"), "}")
+	if !strings.HasPrefix(path, ".") {
+		return nil, fmt.Errorf("path must start with a field, e.g. .spec.template")
+	}
+	fields := strings.Split(strings.TrimPrefix(path, "."), ".")
+	for _, field := range fields {
+		if !fieldPattern.MatchString(field) {
+			return nil, fmt.Errorf("path field %q is not supported, only field names are allowed", field)
+		}
+	}
+	return fields, nil
+}
+
+// targetGroupKind returns the group and kind of a switch target, whose type holds the API version in its group
+func targetGroupKind(target saffirev1alpha1.Target) (schema.GroupVersionKind, error) {
+	groupVersion, err := schema.ParseGroupVersion(target.Type.Group)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return groupVersion.WithKind(target.Type.Kind), nil
+}
+
+// updateTemplatedObject switches the pod template found at path in any kind of workload, by patching it through
+// the dynamic client. The object is read again and the patch retried when it changed in the meantime
+func (r *AlternateImageSourceReconciler) updateTemplatedObject(gvk schema.GroupVersionKind, namespace string, path []string, switches []*saffirev1alpha1.SwitchStatus) error {
+	ctx := context.Background()
+	name := switches[0].Target.Name
+	mapping, err := r.RestMapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return err
+	}
+	resource := r.DynamicClient.Resource(mapping.Resource).Namespace(namespace)
+	podSpecPath := append(append([]string{}, path...), "spec")
+
+	return retry.OnError(patchBackoff, isPatchConflict, func() error {
+		object, err := resource.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		podSpecObject, found, err := unstructured.NestedMap(object.Object, podSpecPath...)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%s %s has no pod template at .%s", gvk.Kind, name, strings.Join(path, "."))
+		}
+		var podSpec corev1.PodSpec
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(podSpecObject, &podSpec); err != nil {
+			return err
+		}
+
+		original := podSpec.DeepCopy()
+		if !applySwitches(&podSpec, switches) {
+			return nil
+		}
+		data, err := json.Marshal(podSpecPatch(podSpecPath, original, &podSpec))
+		if err != nil {
+			return err
+		}
+		_, err = resource.Patch(ctx, name, types.JSONPatchType, data, metav1.PatchOptions{FieldManager: fieldManager})
+		return err
+	})
+}
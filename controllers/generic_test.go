@@ -0,0 +1,173 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func TestParsePodTemplatePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    PodTemplatePaths
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			value: "",
+			want:  PodTemplatePaths{},
+		},
+		{
+			name:  "several kinds",
+			value: "Rollout.argoproj.io={.spec.template}, CloneSet.apps.kruise.io=.spec.template",
+			want: PodTemplatePaths{
+				{Group: "argoproj.io", Kind: "Rollout"}:     {"spec", "template"},
+				{Group: "apps.kruise.io", Kind: "CloneSet"}: {"spec", "template"},
+			},
+		},
+		{
+			name:    "missing path",
+			value:   "Rollout.argoproj.io",
+			wantErr: true,
+		},
+		{
+			name:    "array index",
+			value:   "Workflow.argoproj.io={.spec.templates[0]}",
+			wantErr: true,
+		},
+		{
+			name:    "relative path",
+			value:   "Rollout.argoproj.io=spec.template",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePodTemplatePaths(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_targetGroupKind(t *testing.T) {
+	got, err := targetGroupKind(saffirev1alpha1.Target{Type: metav1.GroupKind{Group: "argoproj.io/v1alpha1", Kind: "Rollout"}})
+	assert.NoError(t, err)
+	assert.Equal(t, schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}, got)
+
+	got, err = targetGroupKind(saffirev1alpha1.Target{Type: metav1.GroupKind{Group: "v1", Kind: "Pod"}})
+	assert.NoError(t, err)
+	assert.Equal(t, schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, got)
+}
+
+func TestAlternateImageSourceReconciler_updateTemplatedObject(t *testing.T) {
+	rolloutGVK := schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}
+	rolloutGVR := schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+	rollout := func(spec map[string]interface{}) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		object.SetGroupVersionKind(rolloutGVK)
+		object.SetNamespace("default")
+		object.SetName("web")
+		return object
+	}
+	template := map[string]interface{}{
+		"template": map[string]interface{}{
+			"spec": map[string]interface{}{
+				"containers": []interface{}{
+					map[string]interface{}{"name": "sidecar", "image": "envoyproxy/envoy:v1.25"},
+					map[string]interface{}{"name": "app", "image": "quay.io/fairwinds/docker-demo:v1"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		object      *unstructured.Unstructured
+		oldImage    string
+		wantErr     string
+		wantPatched bool
+		wantImage   string
+	}{
+		{
+			name:        "patches the pod template at the path",
+			object:      rollout(template),
+			oldImage:    "quay.io/fairwinds/docker-demo:v1",
+			wantPatched: true,
+			wantImage:   "mirror.internal/fairwinds/docker-demo:v1",
+		},
+		{
+			name:      "image does not match",
+			object:    rollout(template),
+			oldImage:  "quay.io/fairwinds/docker-demo:v0",
+			wantImage: "quay.io/fairwinds/docker-demo:v1",
+		},
+		{
+			name:     "no pod template",
+			object:   rollout(map[string]interface{}{"workloadRef": map[string]interface{}{"kind": "Deployment", "name": "web"}}),
+			oldImage: "quay.io/fairwinds/docker-demo:v1",
+			wantErr:  "Rollout web has no pod template at .spec.template",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dynamicClient := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), tt.object.DeepCopy())
+			r := newFakeReconciler()
+			r.RestMapper = newRESTMapper(rolloutGVK)
+			r.DynamicClient = dynamicClient
+			switches := []*saffirev1alpha1.SwitchStatus{{
+				Target:   saffirev1alpha1.Target{Name: "web", Container: "app"},
+				OldImage: tt.oldImage,
+				NewImage: "mirror.internal/fairwinds/docker-demo:v1",
+			}}
+
+			err := r.updateTemplatedObject(rolloutGVK, "default", []string{"spec", "template"}, switches)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+
+			patched := false
+			for _, action := range dynamicClient.Actions() {
+				if action.GetVerb() == "patch" {
+					patched = true
+				}
+			}
+			assert.Equal(t, tt.wantPatched, patched)
+			got, err := dynamicClient.Resource(rolloutGVR).Namespace("default").Get(context.Background(), "web", metav1.GetOptions{})
+			assert.NoError(t, err)
+			containers, _, err := unstructured.NestedSlice(got.Object, "spec", "template", "spec", "containers")
+			assert.NoError(t, err)
+			assert.Equal(t, "envoyproxy/envoy:v1.25", containers[0].(map[string]interface{})["image"])
+			assert.Equal(t, tt.wantImage, containers[1].(map[string]interface{})["image"])
+		})
+	}
+}
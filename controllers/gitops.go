@@ -0,0 +1,300 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+const (
+	// argoCDTrackingAnnotation holds <application>:<group>/<kind>:<namespace>/<name> on objects tracked by annotation
+	argoCDTrackingAnnotation = "argocd.argoproj.io/tracking-id"
+	// argoCDInstanceLabel holds the application of objects tracked by label, the Argo CD default
+	argoCDInstanceLabel = "app.kubernetes.io/instance"
+
+	fluxKustomizationNameLabel      = "kustomize.toolkit.fluxcd.io/name"
+	fluxKustomizationNamespaceLabel = "kustomize.toolkit.fluxcd.io/namespace"
+	fluxHelmReleaseNameLabel        = "helm.toolkit.fluxcd.io/name"
+	fluxHelmReleaseNamespaceLabel   = "helm.toolkit.fluxcd.io/namespace"
+	// fluxReconcileAnnotation set to disabled keeps a Kustomization from changing the object
+	fluxReconcileAnnotation = "kustomize.toolkit.fluxcd.io/reconcile"
+)
+
+var (
+	argoCDApplication = schema.GroupKind{Group: "argoproj.io", Kind: "Application"}
+	fluxKustomization = schema.GroupKind{Group: "kustomize.toolkit.fluxcd.io", Kind: "Kustomization"}
+	fluxHelmRelease   = schema.GroupKind{Group: "helm.toolkit.fluxcd.io", Kind: "HelmRelease"}
+)
+
+// gitOpsOwner is the Argo CD Application or Flux object that manages a target
+type gitOpsOwner struct {
+	kind      schema.GroupKind
+	namespace string
+	name      string
+}
+
+func (o gitOpsOwner) String() string {
+	return fmt.Sprintf("%s %s/%s", o.kind.Kind, o.namespace, o.name)
+}
+
+// gitOpsOwnerOf returns the GitOps owner named by the labels and annotations of an object, or nil when it has none.
+// Flux is checked first, since objects of a HelmRelease also carry the instance label that Argo CD tracks with
+func gitOpsOwnerOf(object metav1.Object, argoCDNamespace string) *gitOpsOwner {
+	labels := object.GetLabels()
+	if name := labels[fluxHelmReleaseNameLabel]; name != "" {
+		return &gitOpsOwner{kind: fluxHelmRelease, namespace: labelOr(labels, fluxHelmReleaseNamespaceLabel, object.GetNamespace()), name: name}
+	}
+	if name := labels[fluxKustomizationNameLabel]; name != "" {
+		return &gitOpsOwner{kind: fluxKustomization, namespace: labelOr(labels, fluxKustomizationNamespaceLabel, object.GetNamespace()), name: name}
+	}
+
+	application := labels[argoCDInstanceLabel]
+	if trackingID := object.GetAnnotations()[argoCDTrackingAnnotation]; trackingID != "" {
+		application = strings.SplitN(trackingID, ":", 2)[0]
+	}
+	if application == "" {
+		return nil
+	}
+	owner := &gitOpsOwner{kind: argoCDApplication, namespace: argoCDNamespace, name: application}
+	// Applications outside of the Argo CD namespace are named namespace_name
+	if parts := strings.SplitN(application, "_", 2); len(parts) == 2 {
+		owner.namespace, owner.name = parts[0], parts[1]
+	}
+	return owner
+}
+
+// labelOr returns the value of a label, or fallback when it is not set
+func labelOr(labels map[string]string, key string, fallback string) string {
+	if value := labels[key]; value != "" {
+		return value
+	}
+	return fallback
+}
+
+// dynamicResource returns the dynamic client of a kind, in its preferred version unless one is given
+func (r *AlternateImageSourceReconciler) dynamicResource(kind schema.GroupKind, versions ...string) (dynamic.NamespaceableResourceInterface, error) {
+	mapping, err := r.RestMapper.RESTMapping(kind, versions...)
+	if err != nil {
+		return nil, err
+	}
+	return r.DynamicClient.Resource(mapping.Resource), nil
+}
+
+// targetGitOpsOwner returns the GitOps owner of the target of a switch, or nil when it is not managed by Argo CD or
+// Flux. Owners that are not installed or do not exist are ignored, such as the Helm release of an object that only
+// shares its instance label with Argo CD
+func (r *AlternateImageSourceReconciler) targetGitOpsOwner(gvk schema.GroupVersionKind, namespace string, name string) (*gitOpsOwner, error) {
+	ctx := context.Background()
+	resource, err := r.dynamicResource(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+	object, err := resource.Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	owner := gitOpsOwnerOf(object, r.ArgoCDNamespace)
+	if owner == nil {
+		return nil, nil
+	}
+
+	ownerResource, err := r.dynamicResource(owner.kind)
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = ownerResource.Namespace(owner.namespace).Get(ctx, owner.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return owner, nil
+}
+
+// applyGitOpsPolicy applies the GitOps policy of an AIS to the switches of a target managed by owner. It reports
+// whether the switches were proposed, in which case the target must be left alone
+func (r *AlternateImageSourceReconciler) applyGitOpsPolicy(ais *saffirev1alpha1.AlternateImageSource, gvk schema.GroupVersionKind, owner *gitOpsOwner, switches []*saffirev1alpha1.SwitchStatus) (bool, error) {
+	for _, switchStatus := range switches {
+		switchStatus.GitOps = owner.String()
+	}
+
+	switch ais.Spec.Switching.GitOps {
+	case saffirev1alpha1.GitOpsPolicyPropose:
+		podSpecPath, ok := r.podSpecPathOf(gvk)
+		if !ok {
+			return false, fmt.Errorf("controller type %s is not supported", gvk.Kind)
+		}
+		for _, switchStatus := range switches {
+			patch, err := proposedPatch(gvk, podSpecPath, switchStatus)
+			if err != nil {
+				return false, err
+			}
+			switchStatus.Phase = saffirev1alpha1.SwitchPhaseProposed
+			switchStatus.ProposedPatch = patch
+		}
+		addMessage(switches, fmt.Sprintf("%s manages the target, apply the proposed patch to its manifests in Git", owner))
+		return true, nil
+	case saffirev1alpha1.GitOpsPolicyPause:
+		message, err := r.pauseGitOps(gvk, ais.Namespace, switches[0].Target.Name, owner)
+		if err != nil {
+			return false, fmt.Errorf("could not pause %s: %w", owner, err)
+		}
+		addMessage(switches, message)
+	default:
+		addMessage(switches, fmt.Sprintf("%s manages the target and will revert the switch on its next sync", owner))
+	}
+	return false, nil
+}
+
+// pauseGitOps keeps the owner of a target from reverting a switch, and returns a message that explains how
+func (r *AlternateImageSourceReconciler) pauseGitOps(gvk schema.GroupVersionKind, namespace string, name string, owner *gitOpsOwner) (string, error) {
+	ctx := context.Background()
+	switch owner.kind {
+	case fluxKustomization:
+		resource, err := r.dynamicResource(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return "", err
+		}
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{fluxReconcileAnnotation: "disabled"},
+			},
+		}
+		if err := mergePatch(ctx, resource.Namespace(namespace), name, patch); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s no longer reconciles the target, remove its %s annotation once the switch is made in Git", owner, fluxReconcileAnnotation), nil
+	case fluxHelmRelease:
+		resource, err := r.dynamicResource(owner.kind)
+		if err != nil {
+			return "", err
+		}
+		patch := map[string]interface{}{
+			"spec": map[string]interface{}{"suspend": true},
+		}
+		if err := mergePatch(ctx, resource.Namespace(owner.namespace), owner.name, patch); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s was suspended, resume it once the switch is made in Git", owner), nil
+	case argoCDApplication:
+		resource, err := r.dynamicResource(owner.kind)
+		if err != nil {
+			return "", err
+		}
+		application, err := resource.Namespace(owner.namespace).Get(ctx, owner.name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		automated, found, err := unstructured.NestedMap(application.Object, "spec", "syncPolicy", "automated")
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return fmt.Sprintf("%s does not sync automatically, it reverts the switch when it is synced", owner), nil
+		}
+		if selfHeal, _, _ := unstructured.NestedBool(automated, "selfHeal"); selfHeal {
+			patch := map[string]interface{}{
+				"spec": map[string]interface{}{
+					"syncPolicy": map[string]interface{}{
+						"automated": map[string]interface{}{"selfHeal": false},
+					},
+				},
+			}
+			if err := mergePatch(ctx, resource.Namespace(owner.namespace), owner.name, patch); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("self healing of %s is off, it reverts the switch when it syncs a new commit", owner), nil
+	default:
+		return "", fmt.Errorf("cannot pause %s", owner.kind.Kind)
+	}
+}
+
+// mergePatch writes a JSON merge patch to an object under the saffire field manager
+func mergePatch(ctx context.Context, resource dynamic.ResourceInterface, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = resource.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{FieldManager: fieldManager})
+	return err
+}
+
+// podSpecPathOf returns the path to the pod spec of a kind of target, and whether the kind can be switched
+func (r *AlternateImageSourceReconciler) podSpecPathOf(gvk schema.GroupVersionKind) ([]string, bool) {
+	if path, ok := r.PodTemplatePaths[gvk.GroupKind()]; ok {
+		return append(append([]string{}, path...), "spec"), true
+	}
+	switch strings.ToLower(gvk.Kind) {
+	case "deployment", "replicaset", "statefulset", "daemonset", "job":
+		return templatePodSpecPath, true
+	case "cronjob":
+		return jobTemplatePodSpecPath, true
+	case "pod":
+		return []string{"spec"}, true
+	default:
+		return nil, false
+	}
+}
+
+// proposedPatch returns a strategic merge patch, in YAML, that makes a switch in the manifest of its target
+func proposedPatch(gvk schema.GroupVersionKind, podSpecPath []string, switchStatus *saffirev1alpha1.SwitchStatus) (string, error) {
+	containers := "containers"
+	if targetContainerType(switchStatus.Target) == saffirev1alpha1.ContainerTypeInitContainer {
+		containers = "initContainers"
+	}
+	podSpec := map[string]interface{}{
+		containers: []interface{}{
+			map[string]interface{}{"name": switchStatus.Target.Container, "image": switchStatus.NewImage},
+		},
+	}
+	if switchStatus.NewImagePullSecret != "" {
+		podSpec["imagePullSecrets"] = []interface{}{
+			map[string]interface{}{"name": switchStatus.NewImagePullSecret},
+		}
+	}
+
+	patch := map[string]interface{}{
+		"apiVersion": gvk.GroupVersion().String(),
+		"kind":       gvk.Kind,
+		"metadata":   map[string]interface{}{"name": switchStatus.Target.Name},
+	}
+	if err := unstructured.SetNestedField(patch, podSpec, podSpecPath...); err != nil {
+		return "", err
+	}
+	data, err := yaml.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,279 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_gitOpsOwnerOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		want        *gitOpsOwner
+	}{
+		{
+			name: "unmanaged",
+			want: nil,
+		},
+		{
+			name: "flux kustomization",
+			labels: map[string]string{
+				fluxKustomizationNameLabel:      "apps",
+				fluxKustomizationNamespaceLabel: "flux-system",
+			},
+			want: &gitOpsOwner{kind: fluxKustomization, namespace: "flux-system", name: "apps"},
+		},
+		{
+			name: "flux helm release before the instance label",
+			labels: map[string]string{
+				fluxHelmReleaseNameLabel: "web",
+				argoCDInstanceLabel:      "web",
+			},
+			want: &gitOpsOwner{kind: fluxHelmRelease, namespace: "default", name: "web"},
+		},
+		{
+			name:   "argo cd label tracking",
+			labels: map[string]string{argoCDInstanceLabel: "web"},
+			want:   &gitOpsOwner{kind: argoCDApplication, namespace: "argocd", name: "web"},
+		},
+		{
+			name:        "argo cd annotation tracking",
+			annotations: map[string]string{argoCDTrackingAnnotation: "web:apps/Deployment:default/web"},
+			want:        &gitOpsOwner{kind: argoCDApplication, namespace: "argocd", name: "web"},
+		},
+		{
+			name:        "argo cd application in any namespace",
+			annotations: map[string]string{argoCDTrackingAnnotation: "team-a_web:apps/Deployment:default/web"},
+			want:        &gitOpsOwner{kind: argoCDApplication, namespace: "team-a", name: "web"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := &metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: tt.labels, Annotations: tt.annotations}
+			assert.Equal(t, tt.want, gitOpsOwnerOf(object, "argocd"))
+		})
+	}
+}
+
+func Test_proposedPatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		gvk          schema.GroupVersionKind
+		podSpecPath  []string
+		switchStatus *saffirev1alpha1.SwitchStatus
+		want         string
+	}{
+		{
+			name:        "deployment container",
+			gvk:         schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			podSpecPath: templatePodSpecPath,
+			switchStatus: &saffirev1alpha1.SwitchStatus{
+				NewImage: "mirror.internal/web:1.0",
+				Target:   saffirev1alpha1.Target{Name: "web", Container: "app"},
+			},
+			want: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - image: mirror.internal/web:1.0
+        name: app
+`,
+		},
+		{
+			name:        "cronjob init container with pull secret",
+			gvk:         schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "CronJob"},
+			podSpecPath: jobTemplatePodSpecPath,
+			switchStatus: &saffirev1alpha1.SwitchStatus{
+				NewImage:           "mirror.internal/migrate:1.0",
+				NewImagePullSecret: "mirror-credentials",
+				Target: saffirev1alpha1.Target{
+					Name:          "nightly",
+					Container:     "migrate",
+					ContainerType: saffirev1alpha1.ContainerTypeInitContainer,
+				},
+			},
+			want: `apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: nightly
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          imagePullSecrets:
+          - name: mirror-credentials
+          initContainers:
+          - image: mirror.internal/migrate:1.0
+            name: migrate
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := proposedPatch(tt.gvk, tt.podSpecPath, tt.switchStatus)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAlternateImageSourceReconciler_switchImage_gitOps(t *testing.T) {
+	deploymentGVK := schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	applicationGVK := argoCDApplication.WithVersion("v1alpha1")
+	helmReleaseGVK := fluxHelmRelease.WithVersion("v2beta1")
+	kustomizationGVK := fluxKustomization.WithVersion("v1")
+	mapper := newRESTMapper(deploymentGVK, applicationGVK, helmReleaseGVK, kustomizationGVK)
+	owner := func(gvk schema.GroupVersionKind, namespace string, spec map[string]interface{}) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		object.SetGroupVersionKind(gvk)
+		object.SetNamespace(namespace)
+		object.SetName("web")
+		return object
+	}
+
+	tests := []struct {
+		name        string
+		policy      saffirev1alpha1.GitOpsPolicy
+		labels      map[string]string
+		owner       *unstructured.Unstructured
+		wantPhase   saffirev1alpha1.SwitchPhase
+		wantImage   string
+		wantMessage string
+		// wantOwner is the field of the owner, or of the Deployment for a Kustomization, that pausing sets, and its value
+		wantOwner      []string
+		wantOwnerValue interface{}
+	}{
+		{
+			name:        "propose leaves the target alone",
+			policy:      saffirev1alpha1.GitOpsPolicyPropose,
+			labels:      map[string]string{argoCDInstanceLabel: "web"},
+			owner:       owner(applicationGVK, "argocd", map[string]interface{}{}),
+			wantPhase:   saffirev1alpha1.SwitchPhaseProposed,
+			wantImage:   "quay.io/fairwinds/docker-demo:v1",
+			wantMessage: "Application argocd/web manages the target, apply the proposed patch to its manifests in Git",
+		},
+		{
+			name:   "pause turns off argo cd self healing",
+			policy: saffirev1alpha1.GitOpsPolicyPause,
+			labels: map[string]string{argoCDInstanceLabel: "web"},
+			owner: owner(applicationGVK, "argocd", map[string]interface{}{
+				"syncPolicy": map[string]interface{}{"automated": map[string]interface{}{"selfHeal": true}},
+			}),
+			wantImage:      "mirror.internal/fairwinds/docker-demo:v1",
+			wantMessage:    "self healing of Application argocd/web is off, it reverts the switch when it syncs a new commit",
+			wantOwner:      []string{"spec", "syncPolicy", "automated", "selfHeal"},
+			wantOwnerValue: false,
+		},
+		{
+			name:           "pause suspends a helm release",
+			policy:         saffirev1alpha1.GitOpsPolicyPause,
+			labels:         map[string]string{fluxHelmReleaseNameLabel: "web", fluxHelmReleaseNamespaceLabel: "flux-system"},
+			owner:          owner(helmReleaseGVK, "flux-system", map[string]interface{}{}),
+			wantImage:      "mirror.internal/fairwinds/docker-demo:v1",
+			wantMessage:    "HelmRelease flux-system/web was suspended, resume it once the switch is made in Git",
+			wantOwner:      []string{"spec", "suspend"},
+			wantOwnerValue: true,
+		},
+		{
+			name:           "pause disables kustomization reconciliation of the target",
+			policy:         saffirev1alpha1.GitOpsPolicyPause,
+			labels:         map[string]string{fluxKustomizationNameLabel: "web", fluxKustomizationNamespaceLabel: "flux-system"},
+			owner:          owner(kustomizationGVK, "flux-system", map[string]interface{}{}),
+			wantImage:      "mirror.internal/fairwinds/docker-demo:v1",
+			wantMessage:    "Kustomization flux-system/web no longer reconciles the target, remove its kustomize.toolkit.fluxcd.io/reconcile annotation once the switch is made in Git",
+			wantOwner:      []string{"metadata", "annotations", fluxReconcileAnnotation},
+			wantOwnerValue: "disabled",
+		},
+		{
+			name:        "warn without a policy",
+			labels:      map[string]string{argoCDInstanceLabel: "web"},
+			owner:       owner(applicationGVK, "argocd", map[string]interface{}{}),
+			wantImage:   "mirror.internal/fairwinds/docker-demo:v1",
+			wantMessage: "Application argocd/web manages the target and will revert the switch on its next sync",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: tt.labels},
+				Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/docker-demo:v1"}},
+				}}},
+			}
+			r := newFakeReconciler(deployment.DeepCopy())
+			r.ArgoCDNamespace = "argocd"
+			r.RestMapper = mapper
+			r.DynamicClient = fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), toUnstructured(t, deployment), tt.owner)
+
+			ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+			ais.Spec.Switching.GitOps = tt.policy
+			switches := []*saffirev1alpha1.SwitchStatus{{
+				Target: saffirev1alpha1.Target{
+					Name:      "web",
+					Container: "app",
+					Type:      metav1.GroupKind{Kind: "Deployment", Group: "apps/v1"},
+				},
+				OldImage: "quay.io/fairwinds/docker-demo:v1",
+				NewImage: "mirror.internal/fairwinds/docker-demo:v1",
+			}}
+
+			assert.NoError(t, r.switchImage(ais, switches))
+
+			assert.Equal(t, tt.wantPhase, switches[0].Phase)
+			assert.Equal(t, tt.wantPhase == saffirev1alpha1.SwitchPhaseProposed, switches[0].ProposedPatch != "")
+			assert.Equal(t, tt.wantMessage, switches[0].Message)
+			assert.Equal(t, tt.owner.GetKind()+" "+tt.owner.GetNamespace()+"/web", switches[0].GitOps)
+			updated := &appsv1.Deployment{}
+			assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(deployment), updated))
+			assert.Equal(t, tt.wantImage, updated.Spec.Template.Spec.Containers[0].Image)
+
+			if tt.wantOwner != nil {
+				paused := tt.owner
+				if paused.GroupVersionKind() == kustomizationGVK {
+					paused = toUnstructured(t, deployment)
+				}
+				mapping, err := mapper.RESTMapping(paused.GroupVersionKind().GroupKind(), paused.GroupVersionKind().Version)
+				assert.NoError(t, err)
+				got, err := r.DynamicClient.Resource(mapping.Resource).Namespace(paused.GetNamespace()).Get(context.Background(), paused.GetName(), metav1.GetOptions{})
+				assert.NoError(t, err)
+				value, found, err := unstructured.NestedFieldNoCopy(got.Object, tt.wantOwner...)
+				assert.NoError(t, err)
+				assert.True(t, found)
+				assert.Equal(t, tt.wantOwnerValue, value)
+			}
+		})
+	}
+}
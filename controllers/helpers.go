@@ -16,36 +16,314 @@ package controllers
 
 import (
 	"fmt"
-	"strings"
+	"time"
 
-	"github.com/thoas/go-funk"
+	corev1 "k8s.io/api/core/v1"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
 )
 
-// parseImageString returns the repository and version of the image string
-func parseImageString(image string) (string, string, error) {
-	parsed := strings.Split(image, ":")
-	if len(parsed) != 2 {
-		return "", "", fmt.Errorf("could not parse image string: %s", image)
+// getAlternateImages returns the alternate images that the replacement rule offers for the image,
+// in order of preference.
+func getAlternateImages(image string, rule replacementRule) ([]string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+
+	if !rule.matches(ref) {
+		return nil, fmt.Errorf("image repository was not matched by the replacement rule")
+	}
+
+	alternates, err := rule.alternates(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(alternates) == 0 {
+		return nil, fmt.Errorf("unable to find next repository to use")
+	}
+	return alternates, nil
+}
+
+// digestReference returns the repository@digest form of an image that is pinned to a digest.
+// It returns an empty string for images that are only tagged or cannot be parsed.
+func digestReference(image string) string {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return ""
 	}
-	return parsed[0], parsed[1], nil
+	return ref.digestReference()
 }
 
-// getNewImage returns a new image string by finding a new repository from the list
-// of equivalentRepositories and appending the version to it.
-func getNewImage(image string, equivalentRepositories []string) (string, error) {
-	oldRepository, version, err := parseImageString(image)
+// tagChange returns the tags of two images when they differ, or empty strings when they are the same
+func tagChange(oldImage string, newImage string) (string, string) {
+	oldRef, err := parseImageReference(oldImage)
 	if err != nil {
-		return "", err
+		return "", ""
+	}
+	newRef, err := parseImageReference(newImage)
+	if err != nil {
+		return "", ""
+	}
+	oldTag, newTag := oldRef.tagOrDefault(), newRef.tagOrDefault()
+	if oldTag == newTag {
+		return "", ""
+	}
+	return oldTag, newTag
+}
+
+// pullSecretFor returns the image pull secret that a replacement rule declares for an image
+func pullSecretFor(image string, rule replacementRule) string {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return ""
+	}
+	return rule.pullSecret(ref)
+}
+
+// switchPodSpec replaces the old image of a switch with the new image in the container that the switch targets,
+// and swaps the image pull secrets of the old and new repositories. It reports whether the pod spec changed.
+func switchPodSpec(podSpec *corev1.PodSpec, switchStatus *saffirev1alpha1.SwitchStatus) bool {
+	if !switchContainerImage(podSpec, switchStatus) {
+		return false
+	}
+
+	if switchStatus.NewImagePullSecret != "" && !hasImagePullSecret(podSpec, switchStatus.NewImagePullSecret) {
+		podSpec.ImagePullSecrets = append(podSpec.ImagePullSecrets, corev1.LocalObjectReference{Name: switchStatus.NewImagePullSecret})
+	}
+	if switchStatus.OldImagePullSecret != "" && switchStatus.OldImagePullSecret != switchStatus.NewImagePullSecret &&
+		!usesRepositoryOf(podSpec, switchStatus.OldImage) {
+		secrets := []corev1.LocalObjectReference{}
+		for _, secret := range podSpec.ImagePullSecrets {
+			if secret.Name != switchStatus.OldImagePullSecret {
+				secrets = append(secrets, secret)
+			}
+		}
+		podSpec.ImagePullSecrets = secrets
+	}
+	return true
+}
+
+// applySwitches applies each of the switches of a single target to its pod spec, so that they can be written in
+// one update. It reports whether the pod spec changed.
+func applySwitches(podSpec *corev1.PodSpec, switches []*saffirev1alpha1.SwitchStatus) bool {
+	changed := false
+	for _, switchStatus := range switches {
+		if switchPodSpec(podSpec, switchStatus) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// switchChange returns a change that applies the switches to a pod spec
+func switchChange(switches []*saffirev1alpha1.SwitchStatus) func(*corev1.PodSpec) bool {
+	return func(podSpec *corev1.PodSpec) bool {
+		return applySwitches(podSpec, switches)
+	}
+}
+
+// switchContainerImage replaces the image of the container that a switch targets with the new image, when it is
+// exactly the old image. Other containers are left alone, even when they use the same image. It reports whether
+// the container changed.
+func switchContainerImage(podSpec *corev1.PodSpec, switchStatus *saffirev1alpha1.SwitchStatus) bool {
+	containers := podSpec.Containers
+	switch targetContainerType(switchStatus.Target) {
+	case saffirev1alpha1.ContainerTypeInitContainer:
+		containers = podSpec.InitContainers
+	case saffirev1alpha1.ContainerTypeEphemeralContainer:
+		return false
+	}
+	for idx, container := range containers {
+		if container.Name == switchStatus.Target.Container && container.Image == switchStatus.OldImage {
+			containers[idx].Image = switchStatus.NewImage
+			return true
+		}
+	}
+	return false
+}
+
+// hasSwitchFor reports whether one of the switches targets the same container as target
+func hasSwitchFor(switches []*saffirev1alpha1.SwitchStatus, target saffirev1alpha1.Target) bool {
+	for _, switchStatus := range switches {
+		if sameContainer(switchStatus.Target, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupByWorkload groups the switches that can be executed by the workload they target, keeping their order.
+// Refused and failed switches are left out.
+func groupByWorkload(switches []*saffirev1alpha1.SwitchStatus) [][]*saffirev1alpha1.SwitchStatus {
+	groups := [][]*saffirev1alpha1.SwitchStatus{}
+	for _, switchStatus := range switches {
+		if switchStatus.Phase != saffirev1alpha1.SwitchPhaseSwitched {
+			continue
+		}
+		grouped := false
+		for idx, group := range groups {
+			if sameWorkload(group[0].Target, switchStatus.Target) {
+				groups[idx] = append(group, switchStatus)
+				grouped = true
+				break
+			}
+		}
+		if !grouped {
+			groups = append(groups, []*saffirev1alpha1.SwitchStatus{switchStatus})
+		}
+	}
+	return groups
+}
+
+// addMessage adds a sentence to the message of each switch
+func addMessage(switches []*saffirev1alpha1.SwitchStatus, message string) {
+	for _, switchStatus := range switches {
+		if switchStatus.Message == "" {
+			switchStatus.Message = message
+		} else {
+			switchStatus.Message += "; " + message
+		}
+	}
+}
+
+// podContainer is a container of any type in a pod spec
+type podContainer struct {
+	name          string
+	image         string
+	containerType saffirev1alpha1.ContainerType
+}
+
+// podContainers returns the init containers, containers and ephemeral containers of a pod spec
+func podContainers(podSpec *corev1.PodSpec) []podContainer {
+	containers := []podContainer{}
+	for _, container := range podSpec.InitContainers {
+		containers = append(containers, podContainer{container.Name, container.Image, saffirev1alpha1.ContainerTypeInitContainer})
+	}
+	for _, container := range podSpec.Containers {
+		containers = append(containers, podContainer{container.Name, container.Image, saffirev1alpha1.ContainerTypeContainer})
+	}
+	for _, container := range podSpec.EphemeralContainers {
+		containers = append(containers, podContainer{container.Name, container.Image, saffirev1alpha1.ContainerTypeEphemeralContainer})
+	}
+	return containers
+}
+
+// failingContainer is a container that is waiting on an image pull error
+type failingContainer struct {
+	podContainer
+	failure pullFailure
+}
+
+// failingContainers returns the containers of a pod that are waiting on an image pull error, with their failure.
+// The Events of the pod add the error of the registry when the status only shows a back-off, and the number of
+// failed pulls. A container that is still waiting is also failing when its Events report a failed pull first
+func failingContainers(pod *corev1.Pod, events []pullEvent) []failingContainer {
+	failing := []failingContainer{}
+	for _, container := range podContainers(&pod.Spec) {
+		status, ok := containerStatusOf(pod, container)
+		if !ok {
+			continue
+		}
+		failure, failed := pullFailureOf(status, container.image)
+		if reported, ok := reportedPullFailure(events, container); ok && status.State.Waiting != nil {
+			switch {
+			case !failed:
+				failure, failed = reported, true
+			case failure.cause == saffirev1alpha1.PullFailureCauseUnknown && reported.message != "":
+				failure.message, failure.cause = reported.message, reported.cause
+			}
+			failure.count = reported.count
+		}
+		if failed {
+			failing = append(failing, failingContainer{container, failure})
+		}
+	}
+	return failing
+}
+
+// containerStatusOf returns the status of a container of a pod, and whether it has one
+func containerStatusOf(pod *corev1.Pod, container podContainer) (corev1.ContainerStatus, bool) {
+	statuses := map[saffirev1alpha1.ContainerType][]corev1.ContainerStatus{
+		saffirev1alpha1.ContainerTypeInitContainer:      pod.Status.InitContainerStatuses,
+		saffirev1alpha1.ContainerTypeContainer:          pod.Status.ContainerStatuses,
+		saffirev1alpha1.ContainerTypeEphemeralContainer: pod.Status.EphemeralContainerStatuses,
+	}
+	for _, status := range statuses[container.containerType] {
+		if status.Name == container.name {
+			return status, true
+		}
+	}
+	return corev1.ContainerStatus{}, false
+}
+
+// sooner returns the shorter of two delays, where zero means no delay is needed
+func sooner(a time.Duration, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
 	}
+	return a
+}
+
+// hasImagePullErr reports whether a container is waiting on an image pull error
+func hasImagePullErr(status corev1.ContainerStatus) bool {
+	_, ok := pullFailureOf(status, status.Image)
+	return ok
+}
 
-	if !funk.ContainsString(equivalentRepositories, oldRepository) {
-		return "", fmt.Errorf("image repository was not found in equivalentRepositories")
+// podContainerStatuses returns the statuses of the init containers, containers and ephemeral containers of a pod
+func podContainerStatuses(pod *corev1.Pod) []corev1.ContainerStatus {
+	statuses := []corev1.ContainerStatus{}
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	statuses = append(statuses, pod.Status.EphemeralContainerStatuses...)
+	return statuses
+}
+
+// targetContainerType returns the container type of a switch target. Targets recorded without a container type are
+// regular containers
+func targetContainerType(target saffirev1alpha1.Target) saffirev1alpha1.ContainerType {
+	if target.ContainerType == "" {
+		return saffirev1alpha1.ContainerTypeContainer
 	}
+	return target.ContainerType
+}
 
-	for _, newRepository := range equivalentRepositories {
-		if newRepository != oldRepository {
-			return fmt.Sprintf("%s:%s", newRepository, version), nil
+// sameContainer reports whether two switch targets are the same container of the same workload
+func sameContainer(a saffirev1alpha1.Target, b saffirev1alpha1.Target) bool {
+	return sameWorkload(a, b) && a.Container == b.Container && targetContainerType(a) == targetContainerType(b)
+}
+
+// sameWorkload reports whether two switch targets are in the same workload
+func sameWorkload(a saffirev1alpha1.Target, b saffirev1alpha1.Target) bool {
+	return a.Name == b.Name && a.Type == b.Type
+}
+
+// hasImagePullSecret reports whether a pod spec references an image pull secret
+func hasImagePullSecret(podSpec *corev1.PodSpec, name string) bool {
+	for _, secret := range podSpec.ImagePullSecrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// usesRepositoryOf reports whether any container of a pod spec still uses the repository of an image
+func usesRepositoryOf(podSpec *corev1.PodSpec, image string) bool {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return false
+	}
+	repository := ref.normalized().repository()
+	for _, container := range podContainers(podSpec) {
+		containerRef, err := parseImageReference(container.image)
+		if err != nil {
+			continue
+		}
+		if containerRef.normalized().repository() == repository {
+			return true
 		}
 	}
-	return "", fmt.Errorf("unable to find next repository to use")
+	return false
 }
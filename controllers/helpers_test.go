@@ -17,39 +17,156 @@ package controllers
 import (
 	"testing"
 
+	"github.com/go-logr/logr"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
 )
 
-func Test_getNewImage(t *testing.T) {
+// newFakeReconciler returns a reconciler whose client serves the objects from memory
+func newFakeReconciler(objects ...client.Object) *AlternateImageSourceReconciler {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = saffirev1alpha1.AddToScheme(scheme)
+	return &AlternateImageSourceReconciler{
+		Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		Log:    logr.Discard(),
+		Scheme: scheme,
+	}
+}
+
+// newRESTMapper returns a RESTMapper of namespaced kinds, where each kind is also the preferred one of its group
+func newRESTMapper(kinds ...schema.GroupVersionKind) meta.RESTMapper {
+	versions := []schema.GroupVersion{}
+	for _, gvk := range kinds {
+		versions = append(versions, gvk.GroupVersion())
+	}
+	mapper := meta.NewDefaultRESTMapper(versions)
+	for _, gvk := range kinds {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+	return mapper
+}
+
+// toUnstructured converts a typed object into the unstructured form that the dynamic client serves
+func toUnstructured(t *testing.T, object runtime.Object) *unstructured.Unstructured {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	assert.NoError(t, err)
+	return &unstructured.Unstructured{Object: content}
+}
+
+func Test_getAlternateImages(t *testing.T) {
 	type args struct {
-		image                  string
-		equivalentRepositories []string
+		image string
+		rule  replacementRule
 	}
 	tests := []struct {
 		name    string
 		args    args
-		want    string
+		want    []string
 		wantErr bool
 	}{
 		{
 			name: "basic",
 			args: args{
 				image: "quay.io/Company/OldRepository:v3.0.0",
-				equivalentRepositories: []string{
+				rule: repositoryRule{equivalentRepositories: []string{
 					"quay.io/Company/OldRepository",
 					"Company/NewRepository",
-				},
+				}},
+			},
+			want:    []string{"Company/NewRepository:v3.0.0"},
+			wantErr: false,
+		},
+		{
+			name: "registry with port",
+			args: args{
+				image: "registry.local:5000/app:v1",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"registry.local:5000/app",
+					"mirror.local/app",
+				}},
 			},
-			want:    "Company/NewRepository:v3.0.0",
+			want:    []string{"mirror.local/app:v1"},
+			wantErr: false,
+		},
+		{
+			name: "implicit latest",
+			args: args{
+				image: "app",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"app",
+					"mirror.local/app",
+				}},
+			},
+			want:    []string{"mirror.local/app"},
+			wantErr: false,
+		},
+		{
+			name: "digest",
+			args: args{
+				image: "app@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"app",
+					"mirror.local/app",
+				}},
+			},
+			want:    []string{"mirror.local/app@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"},
+			wantErr: false,
+		},
+		{
+			name: "tag and digest",
+			args: args{
+				image: "quay.io/Company/OldRepository:v3.0.0@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"quay.io/Company/OldRepository",
+					"Company/NewRepository",
+				}},
+			},
+			want:    []string{"Company/NewRepository:v3.0.0@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"},
+			wantErr: false,
+		},
+		{
+			name: "docker hub short name matches the canonical form",
+			args: args{
+				image: "nginx:1.25",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"index.docker.io/library/nginx",
+					"mirror.internal/nginx",
+				}},
+			},
+			want:    []string{"mirror.internal/nginx:1.25"},
+			wantErr: false,
+		},
+		{
+			name: "switch to docker hub uses the form in the list",
+			args: args{
+				image: "mirror.internal/nginx:1.25",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"docker.io/library/nginx",
+					"nginx",
+					"mirror.internal/nginx",
+				}},
+			},
+			want:    []string{"docker.io/library/nginx:1.25", "nginx:1.25"},
 			wantErr: false,
 		},
 		{
 			name: "error repo not in list",
 			args: args{
 				image: "quay.io/Company/OldRepository:v3.0.0",
-				equivalentRepositories: []string{
+				rule: repositoryRule{equivalentRepositories: []string{
 					"Company/NewRepository",
-				},
+				}},
 			},
 			wantErr: true,
 		},
@@ -57,9 +174,9 @@ func Test_getNewImage(t *testing.T) {
 			name: "bad image passed",
 			args: args{
 				image: "notanimagestring",
-				equivalentRepositories: []string{
+				rule: repositoryRule{equivalentRepositories: []string{
 					"Company/NewRepository",
-				},
+				}},
 			},
 			wantErr: true,
 		},
@@ -67,16 +184,27 @@ func Test_getNewImage(t *testing.T) {
 			name: "only one image",
 			args: args{
 				image: "Company/NewRepository:v3.0.0",
-				equivalentRepositories: []string{
+				rule: repositoryRule{equivalentRepositories: []string{
 					"Company/NewRepository",
-				},
+				}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid replacement repository",
+			args: args{
+				image: "Company/OldRepository:v3.0.0",
+				rule: repositoryRule{equivalentRepositories: []string{
+					"Company/OldRepository",
+					"Company/NewRepository:v1",
+				}},
 			},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := getNewImage(tt.args.image, tt.args.equivalentRepositories)
+			got, err := getAlternateImages(tt.args.image, tt.args.rule)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -87,45 +215,242 @@ func Test_getNewImage(t *testing.T) {
 	}
 }
 
-func Test_parseImageString(t *testing.T) {
+func Test_digestReference(t *testing.T) {
+	digest := "sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"
 
 	tests := []struct {
-		name    string
-		image   string
-		want    string
-		want1   string
-		wantErr bool
+		name  string
+		image string
+		want  string
 	}{
 		{
-			name:    "basic",
-			image:   "quay.io/fairwinds/test:v1.0.0",
-			want:    "quay.io/fairwinds/test",
-			want1:   "v1.0.0",
-			wantErr: false,
+			name:  "digest",
+			image: "quay.io/fairwinds/test@" + digest,
+			want:  "quay.io/fairwinds/test@" + digest,
 		},
 		{
-			name:    "error",
-			image:   "notanimagestring",
-			wantErr: true,
+			name:  "tag and digest",
+			image: "registry.local:5000/fairwinds/test:v1.0.0@" + digest,
+			want:  "registry.local:5000/fairwinds/test@" + digest,
 		},
 		{
-			name:    "basic2",
-			image:   "fairwinds/test:1.0.0",
-			want:    "fairwinds/test",
-			want1:   "1.0.0",
-			wantErr: false,
+			name:  "tag only",
+			image: "quay.io/fairwinds/test:v1.0.0",
+			want:  "",
+		},
+		{
+			name:  "invalid image",
+			image: "not an image",
+			want:  "",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1, err := parseImageString(tt.image)
-			if tt.wantErr {
-				assert.Error(t, err)
-			} else {
-				assert.NoError(t, err)
-				assert.Equal(t, tt.want, got)
-				assert.Equal(t, tt.want1, got1)
+			assert.Equal(t, tt.want, digestReference(tt.image))
+		})
+	}
+}
+
+func Test_tagChange(t *testing.T) {
+	oldTag, newTag := tagChange("quay.io/fairwinds/saffire:v1.2.3", "mirror.internal/saffire:1.2.3-mirror")
+	assert.Equal(t, "v1.2.3", oldTag)
+	assert.Equal(t, "1.2.3-mirror", newTag)
+
+	oldTag, newTag = tagChange("quay.io/fairwinds/saffire:v1.2.3", "mirror.internal/saffire:v1.2.3")
+	assert.Empty(t, oldTag)
+	assert.Empty(t, newTag)
+
+	oldTag, newTag = tagChange("quay.io/fairwinds/saffire", "mirror.internal/saffire:latest-mirror")
+	assert.Equal(t, "latest", oldTag)
+	assert.Equal(t, "latest-mirror", newTag)
+
+	oldTag, newTag = tagChange("quay.io/fairwinds/saffire", "mirror.internal/saffire:latest")
+	assert.Empty(t, oldTag)
+	assert.Empty(t, newTag)
+}
+
+func Test_switchPodSpec(t *testing.T) {
+	tests := []struct {
+		name         string
+		podSpec      corev1.PodSpec
+		switchStatus saffirev1alpha1.SwitchStatus
+		wantChanged  bool
+		wantImages   []string
+		wantSecrets  []corev1.LocalObjectReference
+	}{
+		{
+			name: "adds the new secret",
+			podSpec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/saffire:v1"}},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:             saffirev1alpha1.Target{Container: "app"},
+				OldImage:           "quay.io/fairwinds/saffire:v1",
+				NewImage:           "mirror.internal/saffire:v1",
+				NewImagePullSecret: "mirror-credentials",
+			},
+			wantChanged: true,
+			wantImages:  []string{"mirror.internal/saffire:v1"},
+			wantSecrets: []corev1.LocalObjectReference{{Name: "mirror-credentials"}},
+		},
+		{
+			name: "removes the old secret on a switch back",
+			podSpec: corev1.PodSpec{
+				Containers:       []corev1.Container{{Name: "app", Image: "mirror.internal/saffire:v1"}},
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other"}, {Name: "mirror-credentials"}},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:             saffirev1alpha1.Target{Container: "app"},
+				OldImage:           "mirror.internal/saffire:v1",
+				NewImage:           "quay.io/fairwinds/saffire:v1",
+				OldImagePullSecret: "mirror-credentials",
+			},
+			wantChanged: true,
+			wantImages:  []string{"quay.io/fairwinds/saffire:v1"},
+			wantSecrets: []corev1.LocalObjectReference{{Name: "other"}},
+		},
+		{
+			name: "keeps the old secret while another container uses the repository",
+			podSpec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Image: "mirror.internal/saffire:v1"},
+					{Name: "sidecar", Image: "mirror.internal/saffire:v2"},
+				},
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "mirror-credentials"}},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:             saffirev1alpha1.Target{Container: "app"},
+				OldImage:           "mirror.internal/saffire:v1",
+				NewImage:           "quay.io/fairwinds/saffire:v1",
+				OldImagePullSecret: "mirror-credentials",
+			},
+			wantChanged: true,
+			wantImages:  []string{"quay.io/fairwinds/saffire:v1", "mirror.internal/saffire:v2"},
+			wantSecrets: []corev1.LocalObjectReference{{Name: "mirror-credentials"}},
+		},
+		{
+			name: "switches init containers",
+			podSpec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "migrate", Image: "quay.io/fairwinds/saffire:v1"}},
+				Containers:     []corev1.Container{{Name: "app", Image: "nginx:1.25"}},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:   saffirev1alpha1.Target{Container: "migrate", ContainerType: saffirev1alpha1.ContainerTypeInitContainer},
+				OldImage: "quay.io/fairwinds/saffire:v1",
+				NewImage: "mirror.internal/saffire:v1",
+			},
+			wantChanged: true,
+			wantImages:  []string{"mirror.internal/saffire:v1", "nginx:1.25"},
+		},
+		{
+			name: "leaves other containers alone",
+			podSpec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "app", Image: "quay.io/fairwinds/saffire:v1"},
+					{Name: "sidecar", Image: "quay.io/fairwinds/saffire:v1"},
+					{Name: "other", Image: "registry.local/quay.io/fairwinds/saffire:v1"},
+				},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:   saffirev1alpha1.Target{Container: "app"},
+				OldImage: "quay.io/fairwinds/saffire:v1",
+				NewImage: "mirror.internal/saffire:v1",
+			},
+			wantChanged: true,
+			wantImages:  []string{"mirror.internal/saffire:v1", "quay.io/fairwinds/saffire:v1", "registry.local/quay.io/fairwinds/saffire:v1"},
+		},
+		{
+			name: "only exact images are switched",
+			podSpec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/saffire:v1.1"}},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:   saffirev1alpha1.Target{Container: "app"},
+				OldImage: "quay.io/fairwinds/saffire:v1",
+				NewImage: "mirror.internal/saffire:v1",
+			},
+			wantChanged: false,
+			wantImages:  []string{"quay.io/fairwinds/saffire:v1.1"},
+		},
+		{
+			name: "nothing to switch",
+			podSpec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "nginx:1.25"}},
+			},
+			switchStatus: saffirev1alpha1.SwitchStatus{
+				Target:             saffirev1alpha1.Target{Container: "app"},
+				OldImage:           "quay.io/fairwinds/saffire:v1",
+				NewImage:           "mirror.internal/saffire:v1",
+				NewImagePullSecret: "mirror-credentials",
+			},
+			wantChanged: false,
+			wantImages:  []string{"nginx:1.25"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			podSpec := tt.podSpec.DeepCopy()
+			assert.Equal(t, tt.wantChanged, switchPodSpec(podSpec, &tt.switchStatus))
+			images := []string{}
+			for _, container := range podContainers(podSpec) {
+				images = append(images, container.image)
 			}
+			assert.Equal(t, tt.wantImages, images)
+			assert.Equal(t, tt.wantSecrets, podSpec.ImagePullSecrets)
 		})
 	}
 }
+
+func Test_groupByWorkload(t *testing.T) {
+	deployment := metav1.GroupKind{Group: "apps/v1", Kind: "Deployment"}
+	app := &saffirev1alpha1.SwitchStatus{
+		Target: saffirev1alpha1.Target{Name: "web", Type: deployment, Container: "app"},
+		Phase:  saffirev1alpha1.SwitchPhaseSwitched,
+	}
+	worker := &saffirev1alpha1.SwitchStatus{
+		Target: saffirev1alpha1.Target{Name: "worker", Type: deployment, Container: "app"},
+		Phase:  saffirev1alpha1.SwitchPhaseSwitched,
+	}
+	sidecar := &saffirev1alpha1.SwitchStatus{
+		Target: saffirev1alpha1.Target{Name: "web", Type: deployment, Container: "sidecar"},
+		Phase:  saffirev1alpha1.SwitchPhaseSwitched,
+	}
+	refused := &saffirev1alpha1.SwitchStatus{
+		Target: saffirev1alpha1.Target{Name: "web", Type: deployment, Container: "init", ContainerType: saffirev1alpha1.ContainerTypeInitContainer},
+		Phase:  saffirev1alpha1.SwitchPhaseRefused,
+	}
+
+	got := groupByWorkload([]*saffirev1alpha1.SwitchStatus{app, worker, refused, sidecar})
+	assert.Equal(t, [][]*saffirev1alpha1.SwitchStatus{{app, sidecar}, {worker}}, got)
+}
+
+func Test_failingContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "wait", Image: "busybox:1.36"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "quay.io/fairwinds/saffire:v1"},
+				{Name: "sidecar", Image: "envoyproxy/envoy:v1.25"},
+			},
+		},
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{Name: "wait", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: `Back-off pulling image "busybox:1.36"`}}},
+			},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull", Message: "toomanyrequests: rate limit exceeded"}}},
+				{Name: "sidecar", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}}},
+			},
+		},
+	}
+	assert.Equal(t, []failingContainer{
+		{
+			podContainer: podContainer{name: "wait", image: "busybox:1.36", containerType: saffirev1alpha1.ContainerTypeInitContainer},
+			failure:      pullFailure{reason: "ImagePullBackOff", message: `Back-off pulling image "busybox:1.36"`, cause: saffirev1alpha1.PullFailureCauseUnknown},
+		},
+		{
+			podContainer: podContainer{name: "app", image: "quay.io/fairwinds/saffire:v1", containerType: saffirev1alpha1.ContainerTypeContainer},
+			failure:      pullFailure{reason: "ErrImagePull", message: "toomanyrequests: rate limit exceeded", cause: saffirev1alpha1.PullFailureCauseRateLimited},
+		},
+	}, failingContainers(pod, nil))
+}
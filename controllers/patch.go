@@ -0,0 +1,156 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fieldManager is the field manager that switches are written under
+const fieldManager = "saffire"
+
+// patchBackoff is how often a patch is retried when its target changed in the meantime. It leaves the cache
+// enough time to catch up with the change before the target is read again
+var patchBackoff = retry.DefaultBackoff
+
+// jsonPatchOperation is a single RFC 6902 JSON patch operation
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// patchPodSpec applies a change to the pod spec of an object and writes it with a JSON patch of the changed images and
+// image pull secrets, so that fields owned by others are left alone. The object is read again and the change retried
+// when it changed in the meantime. It reports whether the object was patched.
+func (r *AlternateImageSourceReconciler) patchPodSpec(obj client.Object, path []string, podSpec func() *corev1.PodSpec, change func(*corev1.PodSpec) bool) (bool, error) {
+	ctx := context.Background()
+	patched := false
+	attempt := 0
+	err := retry.OnError(patchBackoff, isPatchConflict, func() error {
+		if attempt > 0 {
+			if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+				return err
+			}
+		}
+		attempt++
+
+		original := podSpec().DeepCopy()
+		if !change(podSpec()) {
+			return nil
+		}
+		data, err := json.Marshal(podSpecPatch(path, original, podSpec()))
+		if err != nil {
+			return err
+		}
+		if err := r.Patch(ctx, obj, client.RawPatch(types.JSONPatchType, data), client.FieldOwner(fieldManager)); err != nil {
+			return err
+		}
+		patched = true
+		return nil
+	})
+	return patched, err
+}
+
+// failedPatchTest matches the message of a JSON patch whose test operation failed
+var failedPatchTest = regexp.MustCompile(`testing value \S+ failed`)
+
+// rejectedPatchMessage is the message that the API server answers a JSON patch that cannot be applied with, such as
+// one whose test operation failed. Validation errors have a message and causes of their own
+const rejectedPatchMessage = "the server rejected our request due to an error in our request"
+
+// isPatchConflict reports whether a patch failed because its target changed since it was read. A failed test
+// operation of a JSON patch is reported as an invalid request, so other invalid requests, such as a bad image or a
+// change to an immutable field, are told apart by their message and causes and are not retried
+func isPatchConflict(err error) bool {
+	if apierrors.IsConflict(err) {
+		return true
+	}
+	var status apierrors.APIStatus
+	if !apierrors.IsInvalid(err) || !errors.As(err, &status) {
+		return false
+	}
+	details := status.Status().Details
+	if details == nil || len(details.Causes) == 0 {
+		return strings.HasPrefix(status.Status().Message, rejectedPatchMessage) || failedPatchTest.MatchString(status.Status().Message)
+	}
+	for _, cause := range details.Causes {
+		if failedPatchTest.MatchString(cause.Message) {
+			return true
+		}
+	}
+	return false
+}
+
+// podSpecPatch returns the JSON patch that turns the original pod spec found at path into the switched one. Each
+// changed image, and the image pull secrets when they change, are tested before they are replaced, so the patch
+// fails if they changed since they were read.
+func podSpecPatch(path []string, original *corev1.PodSpec, switched *corev1.PodSpec) []jsonPatchOperation {
+	pointer := jsonPointer(path)
+	operations := []jsonPatchOperation{}
+	operations = append(operations, containerImagePatch(pointer+"/initContainers", original.InitContainers, switched.InitContainers)...)
+	operations = append(operations, containerImagePatch(pointer+"/containers", original.Containers, switched.Containers)...)
+	if !reflect.DeepEqual(original.ImagePullSecrets, switched.ImagePullSecrets) {
+		secretsPath := pointer + "/imagePullSecrets"
+		if original.ImagePullSecrets != nil {
+			operations = append(operations, jsonPatchOperation{Op: "test", Path: secretsPath, Value: original.ImagePullSecrets})
+		}
+		secrets := switched.ImagePullSecrets
+		if secrets == nil {
+			secrets = []corev1.LocalObjectReference{}
+		}
+		operations = append(operations, jsonPatchOperation{Op: "add", Path: secretsPath, Value: secrets})
+	}
+	return operations
+}
+
+// containerImagePatch returns the JSON patch operations that change the images of the original containers to
+// the images of the switched containers
+func containerImagePatch(pointer string, original []corev1.Container, switched []corev1.Container) []jsonPatchOperation {
+	operations := []jsonPatchOperation{}
+	for idx, container := range switched {
+		if container.Image == original[idx].Image {
+			continue
+		}
+		imagePath := fmt.Sprintf("%s/%d/image", pointer, idx)
+		operations = append(operations,
+			jsonPatchOperation{Op: "test", Path: imagePath, Value: original[idx].Image},
+			jsonPatchOperation{Op: "replace", Path: imagePath, Value: container.Image},
+		)
+	}
+	return operations
+}
+
+// jsonPointer returns the JSON pointer to a field path
+func jsonPointer(path []string) string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	pointer := ""
+	for _, field := range path {
+		pointer += "/" + escaper.Replace(field)
+	}
+	return pointer
+}
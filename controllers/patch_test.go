@@ -0,0 +1,199 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_podSpecPatch(t *testing.T) {
+	original := &corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{Name: "wait", Image: "quay.io/fairwinds/docker-demo:v1"},
+		},
+		Containers: []corev1.Container{
+			{Name: "sidecar", Image: "envoyproxy/envoy:v1.25"},
+			{Name: "app", Image: "quay.io/fairwinds/docker-demo:v1"},
+		},
+	}
+	switched := original.DeepCopy()
+	switched.InitContainers[0].Image = "mirror.internal/fairwinds/docker-demo:v1"
+	switched.Containers[1].Image = "mirror.internal/fairwinds/docker-demo:v1"
+	switched.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "mirror-credentials"}}
+
+	got := podSpecPatch([]string{"spec", "template", "spec"}, original, switched)
+	assert.Equal(t, []jsonPatchOperation{
+		{Op: "test", Path: "/spec/template/spec/initContainers/0/image", Value: "quay.io/fairwinds/docker-demo:v1"},
+		{Op: "replace", Path: "/spec/template/spec/initContainers/0/image", Value: "mirror.internal/fairwinds/docker-demo:v1"},
+		{Op: "test", Path: "/spec/template/spec/containers/1/image", Value: "quay.io/fairwinds/docker-demo:v1"},
+		{Op: "replace", Path: "/spec/template/spec/containers/1/image", Value: "mirror.internal/fairwinds/docker-demo:v1"},
+		{Op: "add", Path: "/spec/template/spec/imagePullSecrets", Value: []corev1.LocalObjectReference{{Name: "mirror-credentials"}}},
+	}, got)
+
+	original = switched.DeepCopy()
+	switched.ImagePullSecrets = nil
+	got = podSpecPatch([]string{"spec"}, original, switched)
+	assert.Equal(t, []jsonPatchOperation{
+		{Op: "test", Path: "/spec/imagePullSecrets", Value: []corev1.LocalObjectReference{{Name: "mirror-credentials"}}},
+		{Op: "add", Path: "/spec/imagePullSecrets", Value: []corev1.LocalObjectReference{}},
+	}, got)
+
+	assert.Empty(t, podSpecPatch([]string{"spec"}, switched, switched.DeepCopy()), "nothing changed")
+}
+
+func Test_jsonPointer(t *testing.T) {
+	assert.Equal(t, "/spec/template/spec", jsonPointer([]string{"spec", "template", "spec"}))
+	assert.Equal(t, "/metadata/annotations/saffire.fairwinds.com~1paused~0", jsonPointer([]string{"metadata", "annotations", "saffire.fairwinds.com/paused~"}))
+}
+
+func Test_isPatchConflict(t *testing.T) {
+	resource := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	assert.True(t, isPatchConflict(apierrors.NewConflict(resource, "web", fmt.Errorf("the object has been modified"))))
+	// the API server drops the message of the failed test operation
+	assert.True(t, isPatchConflict(apierrors.NewGenericServerResponse(http.StatusUnprocessableEntity, "", schema.GroupResource{}, "", "testing value /spec/template/spec/containers/0/image failed: test failed", 0, false)))
+	assert.True(t, isPatchConflict(apierrors.NewGenericServerResponse(http.StatusUnprocessableEntity, "patch", resource, "web", "testing value /spec/template/spec/containers/0/image failed: test failed", 0, true)))
+	assert.False(t, isPatchConflict(apierrors.NewNotFound(resource, "web")))
+	assert.False(t, isPatchConflict(apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "web", field.ErrorList{
+		field.Invalid(field.NewPath("spec", "template", "spec", "containers").Index(0).Child("image"), "Nginx", "invalid reference format"),
+	})))
+	assert.False(t, isPatchConflict(apierrors.NewBadRequest("invalid JSON patch")))
+}
+
+// conflictingClient fails the first patch with err, unless err is nil. When concurrentImage is set, another writer changes the image of
+// the patched Deployment to it before the patch fails
+type conflictingClient struct {
+	client.Client
+	err             error
+	concurrentImage string
+	patches         int
+}
+
+func (c *conflictingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.patches++
+	if c.err == nil {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+	err := c.err
+	c.err = nil
+	if c.concurrentImage != "" {
+		deployment := &appsv1.Deployment{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), deployment); err != nil {
+			return err
+		}
+		deployment.Spec.Template.Spec.Containers[0].Image = c.concurrentImage
+		if err := c.Update(ctx, deployment); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func TestAlternateImageSourceReconciler_patchPodSpec(t *testing.T) {
+	defer func(backoff wait.Backoff) { patchBackoff = backoff }(patchBackoff)
+	patchBackoff = wait.Backoff{Steps: 3}
+
+	resource := schema.GroupResource{Group: "apps", Resource: "deployments"}
+	failedTest := apierrors.NewGenericServerResponse(http.StatusUnprocessableEntity, "patch", resource, "web", "testing value /spec/template/spec/containers/0/image failed: test failed", 0, true)
+	invalidImage := apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "web", field.ErrorList{
+		field.Invalid(field.NewPath("spec", "template", "spec", "containers").Index(0).Child("image"), "Nginx", "invalid reference format"),
+	})
+	tests := []struct {
+		name            string
+		err             error
+		concurrentImage string
+		wantPatched     bool
+		wantErr         bool
+		wantPatches     int
+		wantImage       string
+	}{
+		{
+			name:        "no conflict",
+			wantPatched: true,
+			wantPatches: 1,
+			wantImage:   "mirror.internal/fairwinds/docker-demo:v1",
+		},
+		{
+			name:        "conflict is retried",
+			err:         apierrors.NewConflict(resource, "web", fmt.Errorf("the object has been modified")),
+			wantPatched: true,
+			wantPatches: 2,
+			wantImage:   "mirror.internal/fairwinds/docker-demo:v1",
+		},
+		{
+			name:        "failed test is retried",
+			err:         failedTest,
+			wantPatched: true,
+			wantPatches: 2,
+			wantImage:   "mirror.internal/fairwinds/docker-demo:v1",
+		},
+		{
+			name:            "image changed in the meantime",
+			err:             failedTest,
+			concurrentImage: "quay.io/fairwinds/docker-demo:v2",
+			wantPatches:     1,
+			wantImage:       "quay.io/fairwinds/docker-demo:v2",
+		},
+		{
+			name:        "invalid request is not retried",
+			err:         invalidImage,
+			wantErr:     true,
+			wantPatches: 1,
+			wantImage:   "quay.io/fairwinds/docker-demo:v1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+				Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/docker-demo:v1"}},
+				}}},
+			}
+			r := newFakeReconciler(deployment)
+			conflicting := &conflictingClient{Client: r.Client, err: tt.err, concurrentImage: tt.concurrentImage}
+			r.Client = conflicting
+
+			obj := deployment.DeepCopy()
+			change := switchChange([]*saffirev1alpha1.SwitchStatus{{
+				Target:   saffirev1alpha1.Target{Container: "app"},
+				OldImage: "quay.io/fairwinds/docker-demo:v1",
+				NewImage: "mirror.internal/fairwinds/docker-demo:v1",
+			}})
+			patched, err := r.patchPodSpec(obj, templatePodSpecPath, func() *corev1.PodSpec { return &obj.Spec.Template.Spec }, change)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.wantPatched, patched)
+
+			updated := &appsv1.Deployment{}
+			assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(deployment), updated))
+			assert.Equal(t, tt.wantImage, updated.Spec.Template.Spec.Containers[0].Image)
+			assert.Equal(t, tt.wantPatches, conflicting.patches)
+		})
+	}
+}
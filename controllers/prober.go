@@ -0,0 +1,311 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// probeMaxAge is how many probe intervals the result of a probe is trusted for
+const probeMaxAge = 3
+
+// registryHealth holds the latest health probe of each registry, and the registries of each AIS. A nil
+// registryHealth knows of no registry
+type registryHealth struct {
+	mu         sync.RWMutex
+	registries map[string]saffirev1alpha1.RegistryHealth
+	sources    map[types.NamespacedName][]string
+	// maxAge is how long the result of a probe is trusted
+	maxAge time.Duration
+}
+
+func newRegistryHealth(maxAge time.Duration) *registryHealth {
+	return &registryHealth{
+		registries: map[string]saffirev1alpha1.RegistryHealth{},
+		sources:    map[types.NamespacedName][]string{},
+		maxAge:     maxAge,
+	}
+}
+
+// record stores the result of the probe of a registry
+func (h *registryHealth) record(health saffirev1alpha1.RegistryHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.registries[health.Registry] = health
+}
+
+// setRegistries stores the registries of an AIS
+func (h *registryHealth) setRegistries(ais types.NamespacedName, registries []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sources[ais] = registries
+}
+
+// statusOf returns the health of the registries of an AIS, sorted by registry
+func (h *registryHealth) statusOf(ais types.NamespacedName) []saffirev1alpha1.RegistryHealth {
+	if h == nil {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var statuses []saffirev1alpha1.RegistryHealth
+	for _, registry := range h.sources[ais] {
+		if health, ok := h.registries[registry]; ok {
+			statuses = append(statuses, health)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Registry < statuses[j].Registry })
+	return statuses
+}
+
+// unavailable returns the latest probe of a registry, and reports whether it found the registry unavailable.
+// Probes older than maxAge are not trusted
+func (h *registryHealth) unavailable(registry string, now time.Time) (saffirev1alpha1.RegistryHealth, bool) {
+	if h == nil {
+		return saffirev1alpha1.RegistryHealth{}, false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	health, ok := h.registries[registry]
+	if !ok || health.Available || now.Sub(health.LastProbeTime.Time) > h.maxAge {
+		return saffirev1alpha1.RegistryHealth{}, false
+	}
+	return health, true
+}
+
+// probeImage is a representative image of a repository, with what is needed to query it
+type probeImage struct {
+	image      string
+	namespace  string
+	pullSecret string
+}
+
+// registryOf returns the normalized registry of an image or repository
+func registryOf(image string) (string, bool) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", false
+	}
+	return ref.normalized().domain, true
+}
+
+// probeRegistries probes the registries of every AIS every ProbeInterval until ctx is done, and requests a
+// reconciliation of each AIS with the results
+func (r *AlternateImageSourceReconciler) probeRegistries(ctx context.Context) error {
+	ticker := time.NewTicker(r.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		if err := r.probeAll(ctx); err != nil {
+			r.Log.Error(err, "unable to probe registries")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes the registries of every AIS once. Each registry is probed once, with one image of each of
+// its repositories
+func (r *AlternateImageSourceReconciler) probeAll(ctx context.Context) error {
+	var list saffirev1alpha1.AlternateImageSourceList
+	if err := r.List(ctx, &list); err != nil {
+		return err
+	}
+
+	images := map[string][]probeImage{}
+	for idx := range list.Items {
+		ais := &list.Items[idx]
+		aisImages, err := r.probeImages(ctx, ais)
+		if err != nil {
+			r.Log.Error(err, "unable to find the registries of AlternateImageSource", "namespace", ais.Namespace, "name", ais.Name)
+			continue
+		}
+		registries := []string{}
+		for registry, probes := range aisImages {
+			registries = append(registries, registry)
+			images[registry] = append(images[registry], probes...)
+		}
+		r.health.setRegistries(types.NamespacedName{Namespace: ais.Namespace, Name: ais.Name}, registries)
+	}
+	for registry, probes := range images {
+		health := r.probeRegistry(ctx, registry, probes)
+		if !health.Available {
+			r.Log.Info("registry failed its health probe", "registry", registry, "reason", health.Message)
+		}
+		r.health.record(health)
+	}
+
+	for idx := range list.Items {
+		select {
+		case r.probed <- event.GenericEvent{Object: &list.Items[idx]}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// probeImages returns the images to probe for an AIS, by registry. They are the images of its namespace that its
+// rules match, and their alternates, one for each repository. The registries that its rules name are probed even
+// when no image uses them
+func (r *AlternateImageSourceReconciler) probeImages(ctx context.Context, ais *saffirev1alpha1.AlternateImageSource) (map[string][]probeImage, error) {
+	probes := map[string][]probeImage{}
+	rules, _ := replacementRules(ais.Spec)
+	for _, rule := range rules {
+		for _, registry := range rule.registries() {
+			if _, probed := probes[registry]; !probed {
+				probes[registry] = nil
+			}
+		}
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(ais.Namespace)); err != nil {
+		return nil, err
+	}
+	repositories := map[string]bool{}
+	add := func(image string, pullSecret string) {
+		ref, err := parseImageReference(image)
+		if err != nil {
+			return
+		}
+		normalized := ref.normalized()
+		repository := normalized.domain + "/" + normalized.path
+		if _, ok := probes[normalized.domain]; !ok {
+			probes[normalized.domain] = nil
+		}
+		if repositories[repository] {
+			return
+		}
+		repositories[repository] = true
+		probes[normalized.domain] = append(probes[normalized.domain], probeImage{image: image, namespace: ais.Namespace, pullSecret: pullSecret})
+	}
+	for _, pod := range pods.Items {
+		for _, container := range podContainers(&pod.Spec) {
+			ref, err := parseImageReference(container.image)
+			if err != nil {
+				continue
+			}
+			for _, rule := range rules {
+				if !rule.matches(ref) {
+					continue
+				}
+				add(container.image, rule.pullSecret(ref))
+				alternates, err := getAlternateImages(container.image, rule)
+				if err != nil {
+					continue
+				}
+				for _, alternate := range alternates {
+					add(alternate, pullSecretFor(alternate, rule))
+				}
+			}
+		}
+	}
+	return probes, nil
+}
+
+// probeRegistry checks the API of a registry and the manifests of its images. A registry that answers that a
+// manifest is missing or needs other credentials is available
+func (r *AlternateImageSourceReconciler) probeRegistry(ctx context.Context, registry string, probes []probeImage) saffirev1alpha1.RegistryHealth {
+	health := saffirev1alpha1.RegistryHealth{Registry: registry, Available: true}
+	var slowest time.Duration
+	timed := func(probe func() error) error {
+		start := time.Now()
+		err := probe()
+		if elapsed := time.Since(start); elapsed > slowest {
+			slowest = elapsed
+		}
+		return err
+	}
+
+	if err := timed(func() error { return r.Registry.ping(ctx, registry) }); err != nil {
+		health.Available = false
+		health.Message = err.Error()
+	}
+	for _, probe := range probes {
+		if !health.Available {
+			break
+		}
+		registryClient, err := r.registryFor(ctx, probe.namespace, probe.image, []string{probe.pullSecret})
+		if err != nil {
+			continue
+		}
+		err = timed(func() error {
+			_, err := registryClient.headManifest(ctx, probe.image)
+			return err
+		})
+		if err != nil && !registryAnswered(err) {
+			health.Available = false
+			health.Message = err.Error()
+		}
+	}
+	health.Latency = metav1.Duration{Duration: slowest}
+	health.LastProbeTime = metav1.Now()
+	return health
+}
+
+// registryAnswered reports whether a manifest request failed with an answer of the registry itself
+func registryAnswered(err error) bool {
+	return errors.Is(err, errManifestUnknown) || errors.Is(err, errUnauthorized)
+}
+
+// probeFailure returns why the registry of an image failed its latest health probe, and whether it did
+func (r *AlternateImageSourceReconciler) probeFailure(image string) (string, bool) {
+	registry, ok := registryOf(image)
+	if !ok {
+		return "", false
+	}
+	health, unavailable := r.health.unavailable(registry, time.Now())
+	if !unavailable {
+		return "", false
+	}
+	return fmt.Sprintf("registry %s failed its health probe: %s", registry, health.Message), true
+}
+
+// unavailableRegistryContainers returns the containers of a pod that are still being created on an image from a
+// registry that failed its latest health probe, and whose image was not pulled. Containers waiting after a crash or a
+// configuration error pulled their image already
+func (r *AlternateImageSourceReconciler) unavailableRegistryContainers(pod *corev1.Pod, events []pullEvent) []failingContainer {
+	unavailable := []failingContainer{}
+	for _, container := range podContainers(&pod.Spec) {
+		status, ok := containerStatusOf(pod, container)
+		if !ok || !isCreating(status) || hasPulled(events, container) {
+			continue
+		}
+		if message, failed := r.probeFailure(container.image); failed {
+			unavailable = append(unavailable, failingContainer{container, pullFailure{
+				reason:  "Probe",
+				message: message,
+				cause:   saffirev1alpha1.PullFailureCauseRegistryUnavailable,
+			}})
+		}
+	}
+	return unavailable
+}
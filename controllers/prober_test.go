@@ -0,0 +1,160 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_registryHealth(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	ais := types.NamespacedName{Namespace: "default", Name: "saffire"}
+	health := newRegistryHealth(3 * time.Minute)
+	health.record(saffirev1alpha1.RegistryHealth{Registry: "quay.io", Available: true, LastProbeTime: metav1.NewTime(now)})
+	health.record(saffirev1alpha1.RegistryHealth{Registry: "docker.io", Available: false, Message: "503 Service Unavailable", LastProbeTime: metav1.NewTime(now)})
+	health.record(saffirev1alpha1.RegistryHealth{Registry: "ghcr.io", Available: false, LastProbeTime: metav1.NewTime(now.Add(-5 * time.Minute))})
+	health.setRegistries(ais, []string{"quay.io", "docker.io", "gcr.io"})
+
+	tests := []struct {
+		name     string
+		registry string
+		want     bool
+	}{
+		{name: "available", registry: "quay.io", want: false},
+		{name: "unavailable", registry: "docker.io", want: true},
+		{name: "stale probe", registry: "ghcr.io", want: false},
+		{name: "never probed", registry: "gcr.io", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := health.unavailable(tt.registry, now.Add(time.Minute))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	statuses := health.statusOf(ais)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "docker.io", statuses[0].Registry)
+	assert.Equal(t, "quay.io", statuses[1].Registry)
+
+	var disabled *registryHealth
+	_, unavailable := disabled.unavailable("docker.io", now)
+	assert.False(t, unavailable)
+	assert.Nil(t, disabled.statusOf(ais))
+}
+
+func TestAlternateImageSourceReconciler_probeRegistry(t *testing.T) {
+	server, registry := newTestRegistry(t)
+	host := strings.TrimPrefix(server.URL, "http://")
+	r := &AlternateImageSourceReconciler{Registry: registry}
+
+	tests := []struct {
+		name   string
+		images []string
+		want   bool
+	}{
+		{name: "api only", want: true},
+		{name: "existing manifest", images: []string{host + "/fairwinds/saffire:v1"}, want: true},
+		{name: "missing manifest", images: []string{host + "/fairwinds/saffire:v2"}, want: true},
+		{name: "server error", images: []string{host + "/fairwinds/saffire:v1", host + "/fairwinds/saffire:broken"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probes := []probeImage{}
+			for _, image := range tt.images {
+				probes = append(probes, probeImage{image: image, namespace: "default"})
+			}
+			health := r.probeRegistry(context.Background(), host, probes)
+			assert.Equal(t, host, health.Registry)
+			assert.Equal(t, tt.want, health.Available)
+			assert.Equal(t, tt.want, health.Message == "")
+			assert.False(t, health.LastProbeTime.IsZero())
+		})
+	}
+
+	health := r.probeRegistry(context.Background(), "127.0.0.1:1", nil)
+	assert.False(t, health.Available)
+}
+
+func TestAlternateImageSourceReconciler_probeImages(t *testing.T) {
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+	ais.Spec.ImageSourceReplacements = []saffirev1alpha1.ImageSourceReplacement{
+		{EquivalentRepositories: []string{"quay.io/fairwinds/saffire", "ghcr.io/fairwinds/saffire"}},
+	}
+	ais.Spec.RegistryMirrors = []saffirev1alpha1.RegistryMirror{
+		{EquivalentRegistries: []string{"docker.io/*", "mirror.internal/dockerhub/*"}},
+	}
+	ais.Spec.RepositoryPatterns = []saffirev1alpha1.RepositoryPattern{
+		{Match: "gcr.io/(.*)", Replacements: []string{"registry.local:5000/$1"}},
+	}
+	other := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "other"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "gcr.io/fairwinds/app:v1"}}},
+	}
+	r := newFakeReconciler(ais, other)
+
+	probes, err := r.probeImages(context.Background(), ais)
+	assert.NoError(t, err)
+	registries := []string{}
+	for registry, images := range probes {
+		registries = append(registries, registry)
+		assert.Empty(t, images)
+	}
+	assert.ElementsMatch(t, []string{"quay.io", "ghcr.io", "docker.io", "mirror.internal", "registry.local:5000"}, registries)
+}
+
+func TestAlternateImageSourceReconciler_unavailableRegistryContainers(t *testing.T) {
+	now := time.Now()
+	r := &AlternateImageSourceReconciler{health: newRegistryHealth(3 * time.Minute)}
+	r.health.record(saffirev1alpha1.RegistryHealth{Registry: "quay.io", Available: false, Message: "503 Service Unavailable", LastProbeTime: metav1.NewTime(now)})
+	app := podContainer{name: "app", image: "quay.io/fairwinds/saffire:v1", containerType: saffirev1alpha1.ContainerTypeContainer}
+	tests := []struct {
+		name   string
+		reason string
+		events []pullEvent
+		want   bool
+	}{
+		{name: "creating", reason: "ContainerCreating", want: true},
+		{name: "initializing", reason: "PodInitializing", want: true},
+		{name: "pulled", reason: "ContainerCreating", events: []pullEvent{{container: app, reason: "Pulled", count: 1, lastSeen: now}}},
+		{name: "crash loop", reason: "CrashLoopBackOff"},
+		{name: "config error", reason: "CreateContainerConfigError"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: app.name, Image: app.image}}},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+					{Name: app.name, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: tt.reason}}},
+				}},
+			}
+			unavailable := r.unavailableRegistryContainers(pod, tt.events)
+			assert.Equal(t, tt.want, len(unavailable) == 1)
+			if tt.want {
+				assert.Equal(t, saffirev1alpha1.PullFailureCauseRegistryUnavailable, unavailable[0].failure.cause)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/thoas/go-funk"
+)
+
+const (
+	// dockerHubDomain is the canonical registry host of Docker Hub, used for references without a registry
+	dockerHubDomain = "docker.io"
+	// dockerHubOfficialNamespace holds the official Docker Hub images, which can be referenced without a namespace
+	dockerHubOfficialNamespace = "library"
+	// defaultTag is the tag of references without a tag or digest
+	defaultTag = "latest"
+)
+
+// dockerHubAliases are the registry hosts that all refer to Docker Hub
+var dockerHubAliases = []string{dockerHubDomain, "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com"}
+
+var (
+	// domainPattern matches a registry host with an optional port, e.g. registry.local:5000 or [::1]:5000
+	domainPattern = regexp.MustCompile(`^(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	// pathComponentPattern matches a single component of a repository path.
+	// Upper case is accepted so that existing equivalentRepositories keep matching.
+	pathComponentPattern = regexp.MustCompile(`^[a-zA-Z0-9]+(?:(?:[._]|__|-+)[a-zA-Z0-9]+)*$`)
+	tagPattern           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestPattern        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// imageReference is a parsed container image reference of the form
+// [domain[:port]/]path[:tag][@digest]
+type imageReference struct {
+	// domain is the registry host and port. It is empty when the reference does not name a registry.
+	domain string
+	// path is the repository path within the registry
+	path string
+	// tag is empty when the reference has no explicit tag
+	tag string
+	// digest is empty when the reference is not pinned to a digest
+	digest string
+}
+
+// parseImageReference parses an image string into its registry, repository path, tag and digest
+func parseImageReference(image string) (imageReference, error) {
+	ref := imageReference{}
+	if image == "" {
+		return ref, fmt.Errorf("could not parse image string: empty image")
+	}
+
+	name := image
+	if idx := strings.Index(name, "@"); idx != -1 {
+		ref.digest = name[idx+1:]
+		name = name[:idx]
+		if !digestPattern.MatchString(ref.digest) {
+			return imageReference{}, fmt.Errorf("could not parse image string %s: invalid digest %q", image, ref.digest)
+		}
+	}
+
+	if idx := strings.LastIndex(name, ":"); idx != -1 && idx > strings.LastIndex(name, "/") {
+		ref.tag = name[idx+1:]
+		name = name[:idx]
+		if !tagPattern.MatchString(ref.tag) {
+			return imageReference{}, fmt.Errorf("could not parse image string %s: invalid tag %q", image, ref.tag)
+		}
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) > 1 && isDomain(components[0]) {
+		ref.domain = components[0]
+		components = components[1:]
+		if !domainPattern.MatchString(ref.domain) {
+			return imageReference{}, fmt.Errorf("could not parse image string %s: invalid registry %q", image, ref.domain)
+		}
+	}
+	for _, component := range components {
+		if !pathComponentPattern.MatchString(component) {
+			return imageReference{}, fmt.Errorf("could not parse image string %s: invalid repository %q", image, name)
+		}
+	}
+	ref.path = strings.Join(components, "/")
+
+	return ref, nil
+}
+
+// parseRepository parses a repository name, which must not carry a tag or digest
+func parseRepository(repository string) (imageReference, error) {
+	ref, err := parseImageReference(repository)
+	if err != nil {
+		return imageReference{}, err
+	}
+	if ref.tag != "" || ref.digest != "" {
+		return imageReference{}, fmt.Errorf("repository %s must not include a tag or digest", repository)
+	}
+	return ref, nil
+}
+
+// isDomain reports whether the first component of a name is a registry host rather than part of the path
+func isDomain(component string) bool {
+	return strings.ContainsAny(component, ".:[") || component == "localhost"
+}
+
+// normalizeDomain returns the canonical form of a registry host, so that every Docker Hub alias is docker.io
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(domain)
+	if domain == "" || funk.ContainsString(dockerHubAliases, domain) {
+		return dockerHubDomain
+	}
+	return domain
+}
+
+// normalized returns the canonical form of the reference. References without a registry and every
+// Docker Hub alias become docker.io, and official Docker Hub images get the library namespace,
+// so nginx, docker.io/nginx and index.docker.io/library/nginx are all docker.io/library/nginx
+func (r imageReference) normalized() imageReference {
+	r.domain = normalizeDomain(r.domain)
+	if r.domain == dockerHubDomain && !strings.Contains(r.path, "/") {
+		r.path = dockerHubOfficialNamespace + "/" + r.path
+	}
+	return r
+}
+
+// tagOrDefault returns the tag of the reference, which is latest when it has neither a tag nor a digest
+func (r imageReference) tagOrDefault() string {
+	if r.tag == "" && r.digest == "" {
+		return defaultTag
+	}
+	return r.tag
+}
+
+// normalizePrefix returns the canonical form of a registry host or repository path prefix. Like images, an exact
+// repository on Docker Hub without a namespace is in the official namespace, while a wildcard prefix such as
+// docker.io/bitnami/* keeps its namespace
+func normalizePrefix(prefix string, wildcard bool) string {
+	components := strings.SplitN(prefix, "/", 2)
+	if !isDomain(components[0]) {
+		components = []string{dockerHubDomain, prefix}
+	}
+	components[0] = normalizeDomain(components[0])
+	if !wildcard && components[0] == dockerHubDomain && len(components) == 2 && !strings.Contains(components[1], "/") {
+		components[1] = dockerHubOfficialNamespace + "/" + components[1]
+	}
+	return strings.Join(components, "/")
+}
+
+// repository returns the registry and path of the reference, as written
+func (r imageReference) repository() string {
+	if r.domain == "" {
+		return r.path
+	}
+	return r.domain + "/" + r.path
+}
+
+// suffix returns the tag and digest of the reference, including their separators
+func (r imageReference) suffix() string {
+	suffix := ""
+	if r.tag != "" {
+		suffix += ":" + r.tag
+	}
+	if r.digest != "" {
+		suffix += "@" + r.digest
+	}
+	return suffix
+}
+
+// digestReference returns the repository@digest form of the reference, dropping any tag.
+// It is empty when the reference is not pinned to a digest.
+func (r imageReference) digestReference() string {
+	if r.digest == "" {
+		return ""
+	}
+	return r.repository() + "@" + r.digest
+}
+
+// String returns the reference as an image string
+func (r imageReference) String() string {
+	return r.repository() + r.suffix()
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseImageReference(t *testing.T) {
+	digest := "sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"
+
+	tests := []struct {
+		name    string
+		image   string
+		want    imageReference
+		wantErr bool
+	}{
+		{
+			name:  "basic",
+			image: "quay.io/fairwinds/test:v1.0.0",
+			want:  imageReference{domain: "quay.io", path: "fairwinds/test", tag: "v1.0.0"},
+		},
+		{
+			name:  "basic2",
+			image: "fairwinds/test:1.0.0",
+			want:  imageReference{path: "fairwinds/test", tag: "1.0.0"},
+		},
+		{
+			name:  "implicit latest",
+			image: "notanimagestring",
+			want:  imageReference{path: "notanimagestring"},
+		},
+		{
+			name:  "registry with port",
+			image: "registry.local:5000/app:v1",
+			want:  imageReference{domain: "registry.local:5000", path: "app", tag: "v1"},
+		},
+		{
+			name:  "registry with port and no tag",
+			image: "registry.local:5000/team/app",
+			want:  imageReference{domain: "registry.local:5000", path: "team/app"},
+		},
+		{
+			name:  "localhost",
+			image: "localhost/app:v1",
+			want:  imageReference{domain: "localhost", path: "app", tag: "v1"},
+		},
+		{
+			name:  "digest",
+			image: "app@" + digest,
+			want:  imageReference{path: "app", digest: digest},
+		},
+		{
+			name:  "tag and digest",
+			image: "quay.io/fairwinds/test:v1.0.0@" + digest,
+			want:  imageReference{domain: "quay.io", path: "fairwinds/test", tag: "v1.0.0", digest: digest},
+		},
+		{
+			name:    "empty",
+			image:   "",
+			wantErr: true,
+		},
+		{
+			name:    "empty tag",
+			image:   "app:",
+			wantErr: true,
+		},
+		{
+			name:    "short digest",
+			image:   "app@sha256:abc",
+			wantErr: true,
+		},
+		{
+			name:    "invalid characters",
+			image:   "not an image",
+			wantErr: true,
+		},
+		{
+			name:    "empty path component",
+			image:   "quay.io//app:v1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImageReference(tt.image)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.image, got.String())
+			}
+		})
+	}
+}
+
+func Test_imageReference_normalized(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "docker.io/nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "docker.io/library/nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "index.docker.io/library/nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "registry-1.docker.io/bitnami/nginx", want: "docker.io/bitnami/nginx"},
+		{image: "fairwinds/saffire:v1", want: "docker.io/fairwinds/saffire:v1"},
+		{image: "Quay.IO/fairwinds/saffire:v1", want: "quay.io/fairwinds/saffire:v1"},
+		{image: "registry.local:5000/app", want: "registry.local:5000/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := parseImageReference(tt.image)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, ref.normalized().String())
+		})
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/thoas/go-funk"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// dockerHubRegistry is the host that serves the Docker Hub registry API
+	dockerHubRegistry = "registry-1.docker.io"
+	// registryTimeout bounds every request to a registry
+	registryTimeout = 10 * time.Second
+	// maxManifestSize bounds the manifests and configs read from a registry
+	maxManifestSize = 4 << 20
+)
+
+// manifestMediaTypes are the manifest and index media types that saffire accepts from a registry
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// errManifestUnknown is returned when a registry does not have the requested tag or digest
+var errManifestUnknown = errors.New("manifest unknown")
+
+// errUnauthorized is returned when a registry or its token service denies the credentials of the client
+var errUnauthorized = errors.New("unauthorized")
+
+// RegistryClient queries image registries over the OCI Distribution API
+type RegistryClient struct {
+	// InsecureRegistries are registry hosts that are reached over plain HTTP
+	InsecureRegistries []string
+	httpClient         *http.Client
+	// credentials are sent to registries and token services that ask for them. Requests are anonymous when it is nil
+	credentials *registryCredentials
+}
+
+// registryCredentials are a username and password for a registry
+type registryCredentials struct {
+	username string
+	password string
+}
+
+// withCredentials returns a copy of the client that authenticates with a username and password
+func (c *RegistryClient) withCredentials(credentials registryCredentials) *RegistryClient {
+	authenticated := *c
+	authenticated.credentials = &credentials
+	return &authenticated
+}
+
+// NewRegistryClient returns a RegistryClient
+func NewRegistryClient(insecureRegistries []string) *RegistryClient {
+	return &RegistryClient{
+		InsecureRegistries: insecureRegistries,
+		httpClient:         &http.Client{Timeout: registryTimeout},
+	}
+}
+
+// manifestDescriptor describes a manifest returned by a registry
+type manifestDescriptor struct {
+	mediaType string
+	digest    string
+}
+
+// headManifest checks that the tag or digest of an image exists in its registry
+func (c *RegistryClient) headManifest(ctx context.Context, image string) (manifestDescriptor, error) {
+	descriptor, _, err := c.fetchManifest(ctx, http.MethodHead, image)
+	return descriptor, err
+}
+
+// getManifest returns the manifest or index for the tag or digest of an image
+func (c *RegistryClient) getManifest(ctx context.Context, image string) (manifestDescriptor, []byte, error) {
+	return c.fetchManifest(ctx, http.MethodGet, image)
+}
+
+// fetchManifest requests the manifest for the tag or digest of an image. The body is only read for GET requests.
+func (c *RegistryClient) fetchManifest(ctx context.Context, method string, image string) (manifestDescriptor, []byte, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return manifestDescriptor{}, nil, err
+	}
+	ref = ref.normalized()
+
+	req, err := http.NewRequestWithContext(ctx, method, c.manifestURL(ref), nil)
+	if err != nil {
+		return manifestDescriptor{}, nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return manifestDescriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return manifestDescriptor{}, nil, fmt.Errorf("%w: %s", errManifestUnknown, image)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return manifestDescriptor{}, nil, fmt.Errorf("%w: registry %s returned %s for %s", errUnauthorized, ref.domain, resp.Status, image)
+	default:
+		return manifestDescriptor{}, nil, fmt.Errorf("registry %s returned %s for %s", ref.domain, resp.Status, image)
+	}
+
+	descriptor := manifestDescriptor{
+		mediaType: resp.Header.Get("Content-Type"),
+		digest:    resp.Header.Get("Docker-Content-Digest"),
+	}
+	if method == http.MethodHead {
+		return descriptor, nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return manifestDescriptor{}, nil, err
+	}
+	return descriptor, body, nil
+}
+
+// ping checks that a registry serves the OCI Distribution API. A registry that asks for credentials is answering
+func (c *RegistryClient) ping(ctx context.Context, domain string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.registryURL(domain)+"/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("registry %s returned %s", domain, resp.Status)
+	}
+	return nil
+}
+
+// getBlob returns a blob, such as an image config, from the repository of an image
+func (c *RegistryClient) getBlob(ctx context.Context, image string, digest string) ([]byte, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	ref = ref.normalized()
+
+	blobURL := fmt.Sprintf("%s/v2/%s/blobs/%s", c.registryURL(ref.domain), ref.path, digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry %s returned %s for blob %s", ref.domain, resp.Status, digest)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+}
+
+// platform is an operating system and CPU architecture that an image can run on
+type platform struct {
+	os           string
+	architecture string
+}
+
+func (p platform) String() string {
+	return p.os + "/" + p.architecture
+}
+
+// manifestPlatform is the platform of a manifest or image config
+type manifestPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+// manifestIndex is an OCI image index or Docker manifest list, or an image manifest
+// when Manifests is empty
+type manifestIndex struct {
+	Manifests []struct {
+		Digest   string            `json:"digest"`
+		Platform *manifestPlatform `json:"platform,omitempty"`
+	} `json:"manifests"`
+	Config *struct {
+		Digest string `json:"digest"`
+	} `json:"config,omitempty"`
+}
+
+// platforms returns the platforms that an image is available for. A multi-arch image lists them in its index,
+// a single-arch image declares its platform in its config.
+func (c *RegistryClient) platforms(ctx context.Context, image string) ([]platform, error) {
+	_, body, err := c.getManifest(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	var index manifestIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("could not parse manifest for %s: %w", image, err)
+	}
+
+	platforms := []platform{}
+	if len(index.Manifests) > 0 {
+		for _, manifest := range index.Manifests {
+			// attestation manifests are listed with an unknown platform
+			if manifest.Platform == nil || manifest.Platform.OS == "unknown" {
+				continue
+			}
+			platforms = append(platforms, platform{os: manifest.Platform.OS, architecture: manifest.Platform.Architecture})
+		}
+		return platforms, nil
+	}
+
+	if index.Config == nil || index.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest for %s has neither platforms nor a config", image)
+	}
+	configData, err := c.getBlob(ctx, image, index.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var config manifestPlatform
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("could not parse image config for %s: %w", image, err)
+	}
+	return append(platforms, platform{os: config.OS, architecture: config.Architecture}), nil
+}
+
+// registryURL returns the base URL of a registry host
+func (c *RegistryClient) registryURL(domain string) string {
+	scheme := "https"
+	if funk.ContainsString(c.InsecureRegistries, domain) {
+		scheme = "http"
+	}
+	if domain == dockerHubDomain {
+		domain = dockerHubRegistry
+	}
+	return scheme + "://" + domain
+}
+
+// manifestURL returns the URL of the manifest for the tag or digest of a normalized reference
+func (c *RegistryClient) manifestURL(ref imageReference) string {
+	reference := ref.digest
+	if reference == "" {
+		reference = ref.tag
+	}
+	if reference == "" {
+		reference = "latest"
+	}
+	return fmt.Sprintf("%s/v2/%s/manifests/%s", c.registryURL(ref.domain), ref.path, reference)
+}
+
+// do sends a request to a registry, answering a bearer or basic challenge if the registry returns one
+func (c *RegistryClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if scheme, _ := parseChallenge(challenge); strings.EqualFold(scheme, "basic") && c.credentials != nil {
+		retry.SetBasicAuth(c.credentials.username, c.credentials.password)
+		return c.httpClient.Do(retry)
+	}
+	token, err := c.fetchToken(req.Context(), challenge)
+	if err != nil {
+		return nil, err
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return c.httpClient.Do(retry)
+}
+
+// tokenResponse is the response of a registry token service
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// fetchToken requests a bearer token for a WWW-Authenticate challenge, with the client's credentials if it has any
+func (c *RegistryClient) fetchToken(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return "", fmt.Errorf("registry requires unsupported authentication: %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.credentials != nil {
+		req.SetBasicAuth(c.credentials.username, c.credentials.password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("%w: token service %s returned %s", errUnauthorized, tokenURL.Host, resp.Status)
+	default:
+		return "", fmt.Errorf("token service %s returned %s", tokenURL.Host, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("token service %s returned no token", tokenURL.Host)
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		idx := strings.Index(rest, "=")
+		if idx == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:idx]))
+		rest = rest[idx+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+	}
+	return parts[0], params
+}
+
+// dockerConfigEntry is the entry for a single registry in a docker config
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// dockerConfigJSON is the content of a kubernetes.io/dockerconfigjson secret
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// credentialsFromSecret returns the credentials for a registry host from an image pull secret
+// of type kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg
+func credentialsFromSecret(secret *corev1.Secret, domain string) (registryCredentials, bool, error) {
+	var auths map[string]dockerConfigEntry
+	if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		var config dockerConfigJSON
+		if err := json.Unmarshal(data, &config); err != nil {
+			return registryCredentials{}, false, err
+		}
+		auths = config.Auths
+	} else if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		if err := json.Unmarshal(data, &auths); err != nil {
+			return registryCredentials{}, false, err
+		}
+	} else {
+		return registryCredentials{}, false, fmt.Errorf("secret %s is not an image pull secret", secret.Name)
+	}
+
+	domain = normalizeDomain(domain)
+	for server, entry := range auths {
+		if configServerDomain(server) != domain {
+			continue
+		}
+		if entry.Username != "" {
+			return registryCredentials{username: entry.Username, password: entry.Password}, true, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return registryCredentials{}, false, err
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return registryCredentials{}, false, fmt.Errorf("secret %s has a malformed auth for %s", secret.Name, server)
+		}
+		return registryCredentials{username: parts[0], password: parts[1]}, true, nil
+	}
+	return registryCredentials{}, false, nil
+}
+
+// configServerDomain returns the normalized registry host of a docker config server entry,
+// such as https://index.docker.io/v1/ or quay.io
+func configServerDomain(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	return normalizeDomain(strings.SplitN(server, "/", 2)[0])
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// newTestRegistry serves a registry that requires a bearer token and has a single manifest
+func newTestRegistry(t *testing.T) (*httptest.Server, *RegistryClient) {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "repository:fairwinds/saffire:pull", r.URL.Query().Get("scope"))
+		fmt.Fprint(w, `{"token": "secret"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:fairwinds/saffire:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/fairwinds/saffire/manifests/v1":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", "sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b")
+		case "/v2/fairwinds/saffire/manifests/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	return server, NewRegistryClient([]string{host})
+}
+
+func TestRegistryClient_headManifest(t *testing.T) {
+	server, registry := newTestRegistry(t)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	descriptor, err := registry.headManifest(context.Background(), host+"/fairwinds/saffire:v1")
+	assert.NoError(t, err)
+	assert.Equal(t, "application/vnd.oci.image.index.v1+json", descriptor.mediaType)
+	assert.Equal(t, "sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b", descriptor.digest)
+
+	_, err = registry.headManifest(context.Background(), host+"/fairwinds/saffire:v2")
+	assert.True(t, errors.Is(err, errManifestUnknown))
+
+	_, err = registry.headManifest(context.Background(), host+"/fairwinds/saffire:broken")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, errManifestUnknown))
+}
+
+func TestRegistryClient_manifestURL(t *testing.T) {
+	registry := NewRegistryClient([]string{"registry.local:5000"})
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx", want: "https://registry-1.docker.io/v2/library/nginx/manifests/latest"},
+		{image: "quay.io/fairwinds/saffire:v1", want: "https://quay.io/v2/fairwinds/saffire/manifests/v1"},
+		{
+			image: "registry.local:5000/saffire:v1@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+			want:  "http://registry.local:5000/v2/saffire/manifests/sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := parseImageReference(tt.image)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, registry.manifestURL(ref.normalized()))
+		})
+	}
+}
+
+func Test_parseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull,push"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/nginx:pull,push",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, map[string]string{"realm": "registry"}, params)
+}
+
+func TestRegistryClient_platforms(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/multi/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+		fmt.Fprint(w, `{"manifests": [
+			{"digest": "sha256:a", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:b", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+			{"digest": "sha256:c", "platform": {"os": "unknown", "architecture": "unknown"}}
+		]}`)
+	})
+	mux.HandleFunc("/v2/single/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		fmt.Fprint(w, `{"config": {"digest": "sha256:config"}, "layers": []}`)
+	})
+	mux.HandleFunc("/v2/single/blobs/sha256:config", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"os": "linux", "architecture": "amd64"}`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	registry := NewRegistryClient([]string{host})
+
+	got, err := registry.platforms(context.Background(), host+"/multi:v1")
+	assert.NoError(t, err)
+	assert.Equal(t, []platform{{os: "linux", architecture: "amd64"}, {os: "linux", architecture: "arm64"}}, got)
+
+	got, err = registry.platforms(context.Background(), host+"/single:v1")
+	assert.NoError(t, err)
+	assert.Equal(t, []platform{{os: "linux", architecture: "amd64"}}, got)
+}
+
+func Test_credentialsFromSecret(t *testing.T) {
+	dockerConfigJSON := &corev1.Secret{
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths": {
+				"https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("hub-user:hub-pass")) + `"},
+				"mirror.internal": {"username": "mirror-user", "password": "mirror-pass"}
+			}}`),
+		},
+	}
+	dockerConfig := &corev1.Secret{
+		Data: map[string][]byte{
+			corev1.DockerConfigKey: []byte(`{"quay.io": {"username": "quay-user", "password": "quay-pass"}}`),
+		},
+	}
+
+	credentials, ok, err := credentialsFromSecret(dockerConfigJSON, "docker.io")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, registryCredentials{username: "hub-user", password: "hub-pass"}, credentials)
+
+	credentials, ok, err = credentialsFromSecret(dockerConfigJSON, "mirror.internal")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, registryCredentials{username: "mirror-user", password: "mirror-pass"}, credentials)
+
+	_, ok, err = credentialsFromSecret(dockerConfigJSON, "quay.io")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	credentials, ok, err = credentialsFromSecret(dockerConfig, "quay.io")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, registryCredentials{username: "quay-user", password: "quay-pass"}, credentials)
+
+	_, _, err = credentialsFromSecret(&corev1.Secret{}, "quay.io")
+	assert.Error(t, err)
+}
+
+func TestRegistryClient_basicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	registry := NewRegistryClient([]string{host})
+
+	_, err := registry.headManifest(context.Background(), host+"/saffire:v1")
+	assert.Error(t, err)
+
+	_, err = registry.withCredentials(registryCredentials{username: "user", password: "pass"}).headManifest(context.Background(), host+"/saffire:v1")
+	assert.NoError(t, err)
+}
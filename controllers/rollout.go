@@ -0,0 +1,248 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// defaultRolloutTimeout is how long switched containers have to become ready when the AlternateImageSource sets no timeout
+const defaultRolloutTimeout = 10 * time.Minute
+
+// rolloutCheckInterval is how often the rollouts of switches are checked while they are in progress
+const rolloutCheckInterval = 15 * time.Second
+
+// rolloutState is the state of a switched container in a single pod
+type rolloutState int
+
+const (
+	rolloutPending rolloutState = iota
+	rolloutReady
+	rolloutPullFailed
+)
+
+// trackRollouts follows the rollout of each switch that is in progress, and marks it as succeeded once a pod of the
+// target runs the new image, or as failed when the new image cannot be pulled either or the rollout times out
+func (r *AlternateImageSourceReconciler) trackRollouts(ais *saffirev1alpha1.AlternateImageSource) error {
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods, client.InNamespace(ais.Namespace)); err != nil {
+		return err
+	}
+
+	timeout := defaultRolloutTimeout
+	if ais.Spec.Switching.RolloutTimeout != nil {
+		timeout = ais.Spec.Switching.RolloutTimeout.Duration
+	}
+
+	now := v1.Now()
+	objectCache := map[string]unstructured.Unstructured{}
+	for idx := range ais.Status.Switches {
+		switchStatus := &ais.Status.Switches[idx]
+		if switchStatus.Phase != saffirev1alpha1.SwitchPhaseSwitched {
+			continue
+		}
+
+		switch r.rolloutOf(pods.Items, switchStatus, objectCache) {
+		case rolloutReady:
+			switchStatus.Phase = saffirev1alpha1.SwitchPhaseSucceeded
+			switchStatus.CompletionTime = &now
+		case rolloutPullFailed:
+			switchStatus.Phase = saffirev1alpha1.SwitchPhaseFailed
+			switchStatus.Message = "the new image could not be pulled either"
+			switchStatus.CompletionTime = &now
+		default:
+			// a CronJob only runs the new image on its next schedule, which can be far beyond the timeout
+			if !strings.EqualFold(switchStatus.Target.Type.Kind, "CronJob") && now.Sub(switchStatus.Time.Time) > timeout {
+				switchStatus.Phase = saffirev1alpha1.SwitchPhaseFailed
+				switchStatus.Message = fmt.Sprintf("the new image did not become ready within %s", timeout)
+				switchStatus.CompletionTime = &now
+			}
+		}
+	}
+	return nil
+}
+
+// rolloutOf returns the state of the rollout of a switch across the pods of its target. A single ready pod
+// means the new image works, even while other pods are still starting. The controllers that are looked up are kept
+// in objectCache, which is shared by the switches of a reconciliation.
+func (r *AlternateImageSourceReconciler) rolloutOf(pods []corev1.Pod, switchStatus *saffirev1alpha1.SwitchStatus, objectCache map[string]unstructured.Unstructured) rolloutState {
+	target := switchStatus.Target
+	if switchStatus.NewJob != "" {
+		target.Name = switchStatus.NewJob
+		target.Type.Kind = "Job"
+	}
+
+	state := rolloutPending
+	for idx := range pods {
+		podState := containerRollout(&pods[idx], target, switchStatus.NewImage)
+		if podState == rolloutPending {
+			continue
+		}
+		if !r.isControlledBy(&pods[idx], target, objectCache) {
+			continue
+		}
+		if podState == rolloutReady {
+			return rolloutReady
+		}
+		state = podState
+	}
+	return state
+}
+
+// isControlledBy reports whether the top controller of a pod is the target of a switch. The owner references of the
+// pod answer it for bare pods, pods of the target itself and pods of a Deployment, so the top controller is only
+// looked up for the pods of other nested controllers, such as the Jobs of a CronJob
+func (r *AlternateImageSourceReconciler) isControlledBy(pod *corev1.Pod, target saffirev1alpha1.Target, objectCache map[string]unstructured.Unstructured) bool {
+	if len(pod.OwnerReferences) == 0 {
+		return strings.EqualFold(target.Type.Kind, "Pod") && pod.Name == target.Name
+	}
+	owner := pod.OwnerReferences[0]
+	if strings.EqualFold(owner.Kind, target.Type.Kind) && owner.Name == target.Name {
+		return true
+	}
+	if hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; owner.Kind == "ReplicaSet" && hash != "" && strings.EqualFold(target.Type.Kind, "Deployment") {
+		return owner.Name == target.Name+"-"+hash
+	}
+	controller := r.topControllerOf(pod, objectCache)
+	return controller != nil && controller.GetName() == target.Name && strings.EqualFold(controller.GetKind(), target.Type.Kind)
+}
+
+// containerRollout returns the state of the container of a pod that a switch targets, when it runs the image
+func containerRollout(pod *corev1.Pod, target saffirev1alpha1.Target, image string) rolloutState {
+	statuses := pod.Status.ContainerStatuses
+	if targetContainerType(target) == saffirev1alpha1.ContainerTypeInitContainer {
+		statuses = pod.Status.InitContainerStatuses
+	}
+	runsImage := false
+	for _, container := range podContainers(&pod.Spec) {
+		if container.name == target.Container && container.containerType == targetContainerType(target) && container.image == image {
+			runsImage = true
+		}
+	}
+	if !runsImage {
+		return rolloutPending
+	}
+
+	for _, status := range statuses {
+		if status.Name != target.Container {
+			continue
+		}
+		switch {
+		case status.Ready:
+			return rolloutReady
+		case status.State.Terminated != nil && status.State.Terminated.ExitCode == 0:
+			// init containers and the containers of finished Jobs are done rather than ready
+			return rolloutReady
+		case hasImagePullErr(status):
+			return rolloutPullFailed
+		}
+	}
+	return rolloutPending
+}
+
+// rolloutInProgress reports whether the rollout of any of the switches is still being followed
+func rolloutInProgress(switches []saffirev1alpha1.SwitchStatus) bool {
+	for _, switchStatus := range switches {
+		if switchStatus.Phase == saffirev1alpha1.SwitchPhaseSwitched {
+			return true
+		}
+	}
+	return false
+}
+
+// triedImages returns the images of the current chain of fallbacks of the container of a target, so that a fallback
+// does not return to them. They are the images that were switched to and failed to roll out, and the images that a
+// switch still rolling out is replacing. A switch that succeeded ends the chain, and a switch that failed before
+// anything rolled out is not part of it
+func triedImages(switches []saffirev1alpha1.SwitchStatus, target saffirev1alpha1.Target) []string {
+	tried := []string{}
+	for _, switchStatus := range switches {
+		if !sameContainer(switchStatus.Target, target) {
+			continue
+		}
+		switch {
+		case switchStatus.Phase == saffirev1alpha1.SwitchPhaseSucceeded:
+			tried = []string{}
+		case switchStatus.Phase == saffirev1alpha1.SwitchPhaseSwitched:
+			tried = append(tried, switchStatus.OldImage)
+		case switchStatus.Phase == saffirev1alpha1.SwitchPhaseFailed && switchStatus.CompletionTime != nil && switchStatus.NewImage != "":
+			tried = append(tried, switchStatus.NewImage)
+		}
+	}
+	return tried
+}
+
+// wasTried reports whether an alternate image is one of the tried images, which may have been pinned to the digest
+// that was verified when switching to them
+func wasTried(tried []string, image string) bool {
+	for _, triedImage := range tried {
+		if triedImage == image {
+			return true
+		}
+		if ref, err := parseImageReference(triedImage); err == nil && ref.digest != "" && ref.tag != "" {
+			ref.digest = ""
+			if ref.String() == image {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isFallback reports whether a switch replaces the new image of the latest switch of the same container, after
+// that switch failed to roll out. A fallback is not held back by the delay between switches.
+func isFallback(switches []saffirev1alpha1.SwitchStatus, newSwitchStatus saffirev1alpha1.SwitchStatus) bool {
+	latest := latestSwitchOf(switches, newSwitchStatus.Target)
+	return latest != nil && latest.Phase == saffirev1alpha1.SwitchPhaseFailed && latest.CompletionTime != nil &&
+		latest.NewImage == newSwitchStatus.OldImage
+}
+
+// wasSwitchedAway reports whether the latest switch of the container of a target already updated the target away from
+// an image, or proposed to. Pods that still fail on that image are left to the rollout or to Git instead of being
+// switched again
+func wasSwitchedAway(switches []saffirev1alpha1.SwitchStatus, target saffirev1alpha1.Target, image string) bool {
+	latest := latestSwitchOf(switches, target)
+	if latest == nil || latest.OldImage != image {
+		return false
+	}
+	return latest.Phase == saffirev1alpha1.SwitchPhaseSwitched || latest.Phase == saffirev1alpha1.SwitchPhaseSucceeded ||
+		latest.Phase == saffirev1alpha1.SwitchPhaseProposed ||
+		(latest.Phase == saffirev1alpha1.SwitchPhaseFailed && latest.CompletionTime != nil)
+}
+
+// latestSwitchOf returns the latest switch of the container of a target, or nil when it was never switched
+func latestSwitchOf(switches []saffirev1alpha1.SwitchStatus, target saffirev1alpha1.Target) *saffirev1alpha1.SwitchStatus {
+	var latest *saffirev1alpha1.SwitchStatus
+	for idx, switchStatus := range switches {
+		if !sameContainer(switchStatus.Target, target) {
+			continue
+		}
+		if latest == nil || switchStatus.Time.After(latest.Time.Time) {
+			latest = &switches[idx]
+		}
+	}
+	return latest
+}
@@ -0,0 +1,338 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fairwindsops/controller-utils/pkg/controller"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_containerRollout(t *testing.T) {
+	image := "mirror.internal/fairwinds/docker-demo:v1"
+	tests := []struct {
+		name          string
+		containerType saffirev1alpha1.ContainerType
+		image         string
+		status        corev1.ContainerStatus
+		want          rolloutState
+	}{
+		{
+			name:   "ready",
+			image:  image,
+			status: corev1.ContainerStatus{Name: "app", Ready: true},
+			want:   rolloutReady,
+		},
+		{
+			name:   "pull failed",
+			image:  image,
+			status: corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}},
+			want:   rolloutPullFailed,
+		},
+		{
+			name:   "starting",
+			image:  image,
+			status: corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			want:   rolloutPending,
+		},
+		{
+			name:   "old image",
+			image:  "quay.io/fairwinds/docker-demo:v1",
+			status: corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}},
+			want:   rolloutPending,
+		},
+		{
+			name:          "init container completed",
+			containerType: saffirev1alpha1.ContainerTypeInitContainer,
+			image:         image,
+			status:        corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}},
+			want:          rolloutReady,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{}
+			container := corev1.Container{Name: "app", Image: tt.image}
+			if tt.containerType == saffirev1alpha1.ContainerTypeInitContainer {
+				pod.Spec.InitContainers = []corev1.Container{container}
+				pod.Status.InitContainerStatuses = []corev1.ContainerStatus{tt.status}
+			} else {
+				pod.Spec.Containers = []corev1.Container{container}
+				pod.Status.ContainerStatuses = []corev1.ContainerStatus{tt.status}
+			}
+			target := saffirev1alpha1.Target{Container: "app", ContainerType: tt.containerType}
+			assert.Equal(t, tt.want, containerRollout(pod, target, image))
+		})
+	}
+}
+
+func Test_fallback(t *testing.T) {
+	target := saffirev1alpha1.Target{Name: "web", Container: "app"}
+	completed := metav1.Now()
+	switches := []saffirev1alpha1.SwitchStatus{
+		{
+			Time:     metav1.NewTime(time.Now().Add(-5 * time.Minute)),
+			Target:   target,
+			OldImage: "quay.io/fairwinds/docker-demo:v1",
+			NewImage: "ghcr.io/fairwinds/docker-demo:v1",
+			Phase:    saffirev1alpha1.SwitchPhaseFailed,
+			// failed to update the target, so it never rolled out
+		},
+		{
+			Time:           metav1.NewTime(time.Now().Add(-2 * time.Minute)),
+			Target:         target,
+			OldImage:       "quay.io/fairwinds/docker-demo:v1",
+			NewImage:       "mirror.internal/fairwinds/docker-demo:v1",
+			Phase:          saffirev1alpha1.SwitchPhaseFailed,
+			CompletionTime: &completed,
+		},
+		{
+			Time:     metav1.NewTime(time.Now().Add(-1 * time.Minute)),
+			Target:   saffirev1alpha1.Target{Name: "web", Container: "sidecar"},
+			OldImage: "envoyproxy/envoy:v1.25",
+			NewImage: "mirror.internal/envoyproxy/envoy:v1.25",
+			Phase:    saffirev1alpha1.SwitchPhaseSwitched,
+		},
+	}
+
+	assert.Equal(t, []string{"mirror.internal/fairwinds/docker-demo:v1"}, triedImages(switches, target))
+	assert.Equal(t, []string{"envoyproxy/envoy:v1.25"}, triedImages(switches, switches[2].Target))
+
+	assert.True(t, isFallback(switches, saffirev1alpha1.SwitchStatus{Target: target, OldImage: "mirror.internal/fairwinds/docker-demo:v1"}))
+	assert.False(t, isFallback(switches, saffirev1alpha1.SwitchStatus{Target: target, OldImage: "ghcr.io/fairwinds/docker-demo:v1"}))
+	assert.False(t, isFallback(switches, saffirev1alpha1.SwitchStatus{Target: switches[2].Target, OldImage: "mirror.internal/envoyproxy/envoy:v1.25"}))
+
+	assert.True(t, wasSwitchedAway(switches, target, "quay.io/fairwinds/docker-demo:v1"))
+	assert.False(t, wasSwitchedAway(switches, target, "mirror.internal/fairwinds/docker-demo:v1"))
+
+	assert.True(t, rolloutInProgress(switches))
+	assert.False(t, rolloutInProgress(switches[:2]))
+
+	// a switch that succeeded ends the chain, so the container can go back to the image it was switched away from
+	succeeded := []saffirev1alpha1.SwitchStatus{
+		{
+			Time:           metav1.NewTime(time.Now().Add(-time.Hour)),
+			Target:         target,
+			OldImage:       "quay.io/fairwinds/docker-demo:v1",
+			NewImage:       "ghcr.io/fairwinds/docker-demo:v1",
+			Phase:          saffirev1alpha1.SwitchPhaseSucceeded,
+			CompletionTime: &completed,
+		},
+		{
+			Time:     metav1.NewTime(time.Now().Add(-time.Minute)),
+			Target:   target,
+			OldImage: "ghcr.io/fairwinds/docker-demo:v1",
+			NewImage: "mirror.internal/fairwinds/docker-demo:v1",
+			Phase:    saffirev1alpha1.SwitchPhaseSwitched,
+		},
+	}
+	assert.Equal(t, []string{"ghcr.io/fairwinds/docker-demo:v1"}, triedImages(succeeded, target))
+}
+
+// newDeploymentReconciler returns a reconciler whose clients serve an AIS and the Deployment web, which runs image in
+// the pods of its ReplicaSet web-abc
+func newDeploymentReconciler(t *testing.T, ais *saffirev1alpha1.AlternateImageSource, image string, pods ...*corev1.Pod) *AlternateImageSourceReconciler {
+	replicas := int32(len(pods))
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "deployment-uid"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: image}},
+			}},
+		},
+	}
+	isController := true
+	replicaSet := &appsv1.ReplicaSet{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "ReplicaSet"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-abc",
+			Namespace:       "default",
+			UID:             "replicaset-uid",
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: deployment.UID, Controller: &isController}},
+		},
+	}
+	objects := []client.Object{ais, deployment.DeepCopy(), replicaSet.DeepCopy()}
+	for _, pod := range pods {
+		pod.Namespace = "default"
+		pod.UID = "uid-" + types.UID(pod.Name)
+		pod.Labels = map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: "abc"}
+		pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: replicaSet.Name, UID: replicaSet.UID, Controller: &isController}}
+		objects = append(objects, pod)
+	}
+
+	r := newFakeReconciler(objects...)
+	mapper := newRESTMapper(
+		schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	)
+	dynamicClient := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), toUnstructured(t, deployment), toUnstructured(t, replicaSet))
+	r.RestMapper = mapper
+	r.DynamicClient = dynamicClient
+	r.ControllerClient = controller.Client{Context: context.Background(), Dynamic: dynamicClient, RESTMapper: mapper}
+	return r
+}
+
+// appPod returns a pod whose app container runs image in the given state
+func appPod(name string, image string, status corev1.ContainerStatus) *corev1.Pod {
+	status.Name = "app"
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		Status:     corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{status}},
+	}
+}
+
+func TestAlternateImageSourceReconciler_Reconcile_rollout(t *testing.T) {
+	const (
+		mirror = "mirror.internal/fairwinds/docker-demo:v1"
+		ghcr   = "ghcr.io/fairwinds/docker-demo:v1"
+		quay   = "quay.io/fairwinds/docker-demo:v1"
+	)
+	target := saffirev1alpha1.Target{Name: "web", Container: "app", Type: metav1.GroupKind{Kind: "Deployment", Group: "apps/v1"}}
+	ready := corev1.ContainerStatus{Ready: true, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	backOff := corev1.ContainerStatus{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+		Reason:  "ImagePullBackOff",
+		Message: `Back-off pulling image "` + mirror + `"`,
+	}}}
+	creating := corev1.ContainerStatus{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}}
+
+	tests := []struct {
+		name         string
+		switchedAgo  time.Duration
+		pod          *corev1.Pod
+		wantPhase    saffirev1alpha1.SwitchPhase
+		wantMessage  string
+		wantFallback string
+		wantImage    string
+		wantRequeue  time.Duration
+	}{
+		{
+			name:        "still rolling out",
+			switchedAgo: time.Minute,
+			pod:         appPod("web-abc-1", mirror, creating),
+			wantPhase:   saffirev1alpha1.SwitchPhaseSwitched,
+			wantImage:   mirror,
+			wantRequeue: rolloutCheckInterval,
+		},
+		{
+			name:        "ready",
+			switchedAgo: time.Minute,
+			pod:         appPod("web-abc-1", mirror, ready),
+			wantPhase:   saffirev1alpha1.SwitchPhaseSucceeded,
+			wantImage:   mirror,
+		},
+		{
+			name:         "pull error falls back to the next alternate right away",
+			switchedAgo:  10 * time.Second,
+			pod:          appPod("web-abc-1", mirror, backOff),
+			wantPhase:    saffirev1alpha1.SwitchPhaseFailed,
+			wantMessage:  "the new image could not be pulled either",
+			wantFallback: ghcr,
+			wantImage:    ghcr,
+			wantRequeue:  rolloutCheckInterval,
+		},
+		{
+			name:        "timeout",
+			switchedAgo: 11 * time.Minute,
+			pod:         appPod("web-abc-1", mirror, creating),
+			wantPhase:   saffirev1alpha1.SwitchPhaseFailed,
+			wantMessage: "the new image did not become ready within 10m0s",
+			wantImage:   mirror,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+			ais.Spec.ImageSourceReplacements = []saffirev1alpha1.ImageSourceReplacement{{
+				EquivalentRepositories: []string{"mirror.internal/fairwinds/docker-demo", "ghcr.io/fairwinds/docker-demo", "quay.io/fairwinds/docker-demo"},
+			}}
+			ais.Status.Switches = []saffirev1alpha1.SwitchStatus{{
+				Time:     metav1.NewTime(time.Now().Add(-tt.switchedAgo)),
+				Target:   target,
+				OldImage: quay,
+				NewImage: mirror,
+				Phase:    saffirev1alpha1.SwitchPhaseSwitched,
+			}}
+			r := newDeploymentReconciler(t, ais, mirror, tt.pod)
+
+			result, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(ais)})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantRequeue, result.RequeueAfter)
+
+			updated := &saffirev1alpha1.AlternateImageSource{}
+			assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(ais), updated))
+			switches := updated.Status.Switches
+			assert.Equal(t, tt.wantPhase, switches[0].Phase)
+			assert.Equal(t, tt.wantMessage, switches[0].Message)
+			assert.Equal(t, tt.wantPhase != saffirev1alpha1.SwitchPhaseSwitched, switches[0].CompletionTime != nil)
+			if tt.wantFallback == "" {
+				assert.Len(t, switches, 1)
+			} else if assert.Len(t, switches, 2) {
+				assert.Equal(t, saffirev1alpha1.SwitchPhaseSwitched, switches[1].Phase)
+				assert.Equal(t, mirror, switches[1].OldImage)
+				assert.Equal(t, tt.wantFallback, switches[1].NewImage)
+			}
+
+			deployment := &appsv1.Deployment{}
+			assert.NoError(t, r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "web"}, deployment))
+			assert.Equal(t, tt.wantImage, deployment.Spec.Template.Spec.Containers[0].Image)
+		})
+	}
+}
+
+func TestAlternateImageSourceReconciler_isControlledBy(t *testing.T) {
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Name: "saffire", Namespace: "default"}}
+	ready := corev1.ContainerStatus{Ready: true}
+	hashed := appPod("web-abc-1", "quay.io/fairwinds/docker-demo:v1", ready)
+	unhashed := appPod("web-abc-2", "quay.io/fairwinds/docker-demo:v1", ready)
+	r := newDeploymentReconciler(t, ais, "quay.io/fairwinds/docker-demo:v1", hashed, unhashed)
+	unhashed.Labels = nil
+	bare := appPod("debug", "quay.io/fairwinds/docker-demo:v1", ready)
+	dynamicClient := r.DynamicClient.(*fakedynamic.FakeDynamicClient)
+	deployment := saffirev1alpha1.Target{Name: "web", Type: metav1.GroupKind{Kind: "Deployment", Group: "apps/v1"}}
+	objectCache := map[string]unstructured.Unstructured{}
+
+	assert.True(t, r.isControlledBy(hashed, deployment, objectCache))
+	assert.Empty(t, dynamicClient.Actions(), "the template hash names the ReplicaSet of the Deployment")
+	assert.False(t, r.isControlledBy(hashed, saffirev1alpha1.Target{Name: "api", Type: deployment.Type}, objectCache))
+	assert.True(t, r.isControlledBy(hashed, saffirev1alpha1.Target{Name: "web-abc", Type: metav1.GroupKind{Kind: "ReplicaSet", Group: "apps/v1"}}, objectCache))
+	assert.Empty(t, dynamicClient.Actions())
+
+	assert.True(t, r.isControlledBy(unhashed, deployment, objectCache))
+	lookups := len(dynamicClient.Actions())
+	assert.NotZero(t, lookups)
+	assert.True(t, r.isControlledBy(unhashed, deployment, objectCache))
+	assert.Equal(t, lookups, len(dynamicClient.Actions()), "the controllers are read once per cache")
+
+	assert.True(t, r.isControlledBy(bare, saffirev1alpha1.Target{Name: "debug", Type: metav1.GroupKind{Kind: "Pod", Group: "v1"}}, objectCache))
+	assert.False(t, r.isControlledBy(bare, deployment, objectCache))
+}
@@ -0,0 +1,439 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thoas/go-funk"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// replacementRule finds the images that are equivalent to an image
+type replacementRule interface {
+	// matches reports whether the rule applies to the image reference
+	matches(ref imageReference) bool
+	// alternates returns the images equivalent to the reference in order of preference
+	alternates(ref imageReference) ([]string, error)
+	// pullSecret returns the name of the image pull secret that the reference needs, if the rule declares one
+	pullSecret(ref imageReference) string
+	// registries returns the normalized registries that the rule names, as far as they are known without an image
+	registries() []string
+}
+
+// replacementRules returns every replacement rule declared in an AlternateImageSourceSpec.
+// Rules that fail validation are left out and reported in the returned error.
+func replacementRules(spec saffirev1alpha1.AlternateImageSourceSpec) ([]replacementRule, error) {
+	rules := []replacementRule{}
+	errs := []error{}
+	for _, replacement := range spec.ImageSourceReplacements {
+		rule, err := newRepositoryRule(replacement)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	for _, mirror := range spec.RegistryMirrors {
+		rules = append(rules, newRegistryMirrorRule(mirror.EquivalentRegistries))
+	}
+	for _, pattern := range spec.RepositoryPatterns {
+		rule, err := newPatternRule(pattern)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, utilerrors.NewAggregate(errs)
+}
+
+// repositoryRule switches between a list of equivalent repositories
+type repositoryRule struct {
+	equivalentRepositories []string
+	// tagTransforms holds the tag transform of each repository that declares one
+	tagTransforms map[string]tagTransform
+	// pullSecrets holds the image pull secret of each repository that declares one
+	pullSecrets map[string]string
+}
+
+// newRepositoryRule validates an ImageSourceReplacement and compiles its repository options
+func newRepositoryRule(replacement saffirev1alpha1.ImageSourceReplacement) (repositoryRule, error) {
+	rule := repositoryRule{
+		equivalentRepositories: replacement.EquivalentRepositories,
+		tagTransforms:          map[string]tagTransform{},
+		pullSecrets:            map[string]string{},
+	}
+	for _, options := range replacement.RepositoryOptions {
+		if !funk.ContainsString(replacement.EquivalentRepositories, options.Repository) {
+			return repositoryRule{}, fmt.Errorf("repository options for %s do not match any of the equivalentRepositories", options.Repository)
+		}
+		if options.TagTransform != nil {
+			transform, err := newTagTransform(*options.TagTransform)
+			if err != nil {
+				return repositoryRule{}, fmt.Errorf("invalid tag transform for %s: %w", options.Repository, err)
+			}
+			rule.tagTransforms[options.Repository] = transform
+		}
+		if options.ImagePullSecret != "" {
+			rule.pullSecrets[options.Repository] = options.ImagePullSecret
+		}
+	}
+	return rule, nil
+}
+
+// matchingRepository returns the entry of equivalentRepositories that names the same repository as the reference.
+// An entry written exactly like the image is preferred, otherwise entries are compared in their normalized form.
+func (rule repositoryRule) matchingRepository(ref imageReference) (string, bool) {
+	if funk.ContainsString(rule.equivalentRepositories, ref.repository()) {
+		return ref.repository(), true
+	}
+	normalized := ref.normalized().repository()
+	for _, repository := range rule.equivalentRepositories {
+		candidate, err := parseRepository(repository)
+		if err != nil {
+			continue
+		}
+		if candidate.normalized().repository() == normalized {
+			return repository, true
+		}
+	}
+	return "", false
+}
+
+func (rule repositoryRule) matches(ref imageReference) bool {
+	_, ok := rule.matchingRepository(ref)
+	return ok
+}
+
+func (rule repositoryRule) alternates(ref imageReference) ([]string, error) {
+	oldRepository, ok := rule.matchingRepository(ref)
+	if !ok {
+		return nil, nil
+	}
+	normalized := ref.normalized().repository()
+	alternates := []string{}
+	for _, newRepository := range rule.equivalentRepositories {
+		newRef, err := parseRepository(newRepository)
+		if err != nil {
+			return nil, err
+		}
+		if newRef.normalized().repository() == normalized {
+			continue
+		}
+		// the repository is written back as it appears in the list, not in its normalized form
+		newRef.tag, newRef.digest = ref.tag, ref.digest
+		if tag := ref.tagOrDefault(); tag != "" {
+			newRef.tag, err = rule.transformTag(oldRepository, newRepository, tag)
+			if err != nil {
+				return nil, err
+			}
+			// an implicit tag stays implicit unless it was transformed
+			if ref.tag == "" && newRef.tag == defaultTag {
+				newRef.tag = ""
+			}
+		}
+		alternates = append(alternates, newRef.String())
+	}
+	return alternates, nil
+}
+
+func (rule repositoryRule) pullSecret(ref imageReference) string {
+	repository, ok := rule.matchingRepository(ref)
+	if !ok {
+		return ""
+	}
+	return rule.pullSecrets[repository]
+}
+
+func (rule repositoryRule) registries() []string {
+	registries := []string{}
+	for _, repository := range rule.equivalentRepositories {
+		if registry, ok := registryOf(repository); ok && !funk.ContainsString(registries, registry) {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+// transformTag converts a tag from the tag scheme of one repository to the tag scheme of another
+func (rule repositoryRule) transformTag(oldRepository, newRepository, tag string) (string, error) {
+	oldTransform, hasOld := rule.tagTransforms[oldRepository]
+	newTransform, hasNew := rule.tagTransforms[newRepository]
+	if !hasOld && !hasNew {
+		return tag, nil
+	}
+	newTag := newTransform.apply(oldTransform.strip(tag))
+	if !tagPattern.MatchString(newTag) {
+		return "", fmt.Errorf("tag %s transformed for %s is not a valid tag: %s", tag, newRepository, newTag)
+	}
+	return newTag, nil
+}
+
+// tagTransform is a compiled TagTransform
+type tagTransform struct {
+	prefix      string
+	suffix      string
+	match       *regexp.Regexp
+	replacement string
+}
+
+// newTagTransform compiles a TagTransform
+func newTagTransform(transform saffirev1alpha1.TagTransform) (tagTransform, error) {
+	compiled := tagTransform{
+		prefix:      transform.Prefix,
+		suffix:      transform.Suffix,
+		replacement: transform.Replacement,
+	}
+	if transform.Match != "" {
+		match, err := regexp.Compile(transform.Match)
+		if err != nil {
+			return tagTransform{}, err
+		}
+		if err := validateExpansion(match, transform.Replacement); err != nil {
+			return tagTransform{}, err
+		}
+		compiled.match = match
+	}
+	return compiled, nil
+}
+
+// strip removes the prefix and suffix of the repository's tag scheme from a tag
+func (t tagTransform) strip(tag string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(tag, t.prefix), t.suffix)
+}
+
+// apply rewrites a tag into the repository's tag scheme
+func (t tagTransform) apply(tag string) string {
+	if t.match != nil {
+		tag = t.match.ReplaceAllString(tag, t.replacement)
+	}
+	return t.prefix + tag + t.suffix
+}
+
+// registryMirrorRule switches between registries or path prefixes that serve the same repositories,
+// keeping the rest of the repository path
+type registryMirrorRule struct {
+	// prefixes are written back into images as they appear in the AlternateImageSource
+	prefixes []string
+	// normalizedPrefixes are used for matching
+	normalizedPrefixes []string
+}
+
+// newRegistryMirrorRule returns a registryMirrorRule for prefixes such as docker.io/* or mirror.internal/dockerhub
+func newRegistryMirrorRule(equivalentRegistries []string) registryMirrorRule {
+	rule := registryMirrorRule{}
+	for _, registry := range equivalentRegistries {
+		prefix := strings.TrimSuffix(strings.TrimSuffix(registry, "*"), "/")
+		rule.prefixes = append(rule.prefixes, prefix)
+		rule.normalizedPrefixes = append(rule.normalizedPrefixes, normalizePrefix(prefix, strings.HasSuffix(registry, "*")))
+	}
+	return rule
+}
+
+// matchingPrefix returns the normalized prefix that the repository falls under, and the path below it
+func (rule registryMirrorRule) matchingPrefix(ref imageReference) (string, string, bool) {
+	repository := ref.normalized().repository()
+	for _, prefix := range rule.normalizedPrefixes {
+		if repository == prefix {
+			return prefix, "", true
+		}
+		if strings.HasPrefix(repository, prefix+"/") {
+			return prefix, strings.TrimPrefix(repository, prefix+"/"), true
+		}
+	}
+	return "", "", false
+}
+
+func (rule registryMirrorRule) matches(ref imageReference) bool {
+	_, _, ok := rule.matchingPrefix(ref)
+	return ok
+}
+
+func (rule registryMirrorRule) pullSecret(ref imageReference) string {
+	return ""
+}
+
+func (rule registryMirrorRule) registries() []string {
+	registries := []string{}
+	for _, prefix := range rule.normalizedPrefixes {
+		registry := strings.SplitN(prefix, "/", 2)[0]
+		if !funk.ContainsString(registries, registry) {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+func (rule registryMirrorRule) alternates(ref imageReference) ([]string, error) {
+	oldPrefix, rest, ok := rule.matchingPrefix(ref)
+	if !ok {
+		return nil, nil
+	}
+	alternates := []string{}
+	for idx, prefix := range rule.prefixes {
+		if rule.normalizedPrefixes[idx] == oldPrefix {
+			continue
+		}
+		newRepository := prefix
+		if rest != "" {
+			newRepository += "/" + rest
+		}
+		if _, err := parseRepository(newRepository); err != nil {
+			return nil, err
+		}
+		alternates = append(alternates, newRepository+ref.suffix())
+	}
+	return alternates, nil
+}
+
+// patternRule rewrites repositories that match a compiled expression, expanding captured groups into the replacements
+type patternRule struct {
+	expression   *regexp.Regexp
+	replacements []string
+}
+
+// newPatternRule compiles and validates a RepositoryPattern
+func newPatternRule(pattern saffirev1alpha1.RepositoryPattern) (patternRule, error) {
+	if len(pattern.Replacements) == 0 {
+		return patternRule{}, fmt.Errorf("repository pattern %s has no replacements", pattern.Match)
+	}
+
+	var expression string
+	switch pattern.Syntax {
+	case "", saffirev1alpha1.PatternSyntaxRegex:
+		expression = pattern.Match
+	case saffirev1alpha1.PatternSyntaxGlob:
+		expression = globToRegex(pattern.Match)
+	default:
+		return patternRule{}, fmt.Errorf("repository pattern %s has unknown syntax %s", pattern.Match, pattern.Syntax)
+	}
+
+	compiled, err := regexp.Compile("^(?:" + expression + ")$")
+	if err != nil {
+		return patternRule{}, fmt.Errorf("could not compile repository pattern %s: %w", pattern.Match, err)
+	}
+
+	for _, replacement := range pattern.Replacements {
+		if err := validateExpansion(compiled, replacement); err != nil {
+			return patternRule{}, fmt.Errorf("invalid replacement %s for repository pattern %s: %w", replacement, pattern.Match, err)
+		}
+	}
+
+	return patternRule{expression: compiled, replacements: pattern.Replacements}, nil
+}
+
+// globToRegex converts a glob into a regular expression that captures each wildcard
+func globToRegex(glob string) string {
+	var builder strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			builder.WriteString("(.+)")
+			i++
+		case glob[i] == '*':
+			builder.WriteString("([^/]+)")
+		default:
+			builder.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return builder.String()
+}
+
+// expansionPattern finds $1, ${1} and ${name} references in a replacement
+var expansionPattern = regexp.MustCompile(`\$(?:\{([a-zA-Z0-9_]+)\}|([a-zA-Z0-9_]+))`)
+
+// validateExpansion makes sure that every group referenced in a replacement is captured by the expression
+func validateExpansion(expression *regexp.Regexp, replacement string) error {
+	names := expression.SubexpNames()
+	for _, match := range expansionPattern.FindAllStringSubmatch(replacement, -1) {
+		group := match[1] + match[2]
+		if index, err := strconv.Atoi(group); err == nil {
+			if index > expression.NumSubexp() {
+				return fmt.Errorf("group %d is not captured", index)
+			}
+			continue
+		}
+		if !funk.ContainsString(names, group) {
+			return fmt.Errorf("group %s is not captured", group)
+		}
+	}
+	return nil
+}
+
+// matchingRepository returns the form of the image's repository that the expression matches, and the captured groups.
+// The image as written is tried first, then its normalized form.
+func (rule patternRule) matchingRepository(ref imageReference) (string, []int) {
+	for _, repository := range []string{ref.repository(), ref.normalized().repository()} {
+		if submatches := rule.expression.FindStringSubmatchIndex(repository); submatches != nil {
+			return repository, submatches
+		}
+	}
+	return "", nil
+}
+
+func (rule patternRule) matches(ref imageReference) bool {
+	_, submatches := rule.matchingRepository(ref)
+	return submatches != nil
+}
+
+func (rule patternRule) pullSecret(ref imageReference) string {
+	return ""
+}
+
+// registries returns the registries of the replacements. A replacement whose registry is made of captured groups
+// is left out, since it depends on the image
+func (rule patternRule) registries() []string {
+	registries := []string{}
+	for _, replacement := range rule.replacements {
+		components := strings.SplitN(replacement, "/", 2)
+		if len(components) == 1 || strings.Contains(components[0], "$") {
+			continue
+		}
+		registry := dockerHubDomain
+		if isDomain(components[0]) {
+			registry = normalizeDomain(components[0])
+		}
+		if !funk.ContainsString(registries, registry) {
+			registries = append(registries, registry)
+		}
+	}
+	return registries
+}
+
+func (rule patternRule) alternates(ref imageReference) ([]string, error) {
+	repository, submatches := rule.matchingRepository(ref)
+	if submatches == nil {
+		return nil, nil
+	}
+	alternates := []string{}
+	for _, replacement := range rule.replacements {
+		newRepository := string(rule.expression.ExpandString(nil, replacement, repository, submatches))
+		newRef, err := parseRepository(newRepository)
+		if err != nil {
+			return nil, err
+		}
+		if newRef.normalized().repository() == ref.normalized().repository() {
+			continue
+		}
+		alternates = append(alternates, newRepository+ref.suffix())
+	}
+	return alternates, nil
+}
@@ -0,0 +1,430 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_registryMirrorRule(t *testing.T) {
+	tests := []struct {
+		name                 string
+		equivalentRegistries []string
+		image                string
+		wantMatch            bool
+		want                 []string
+		wantErr              bool
+	}{
+		{
+			name:                 "registry host",
+			equivalentRegistries: []string{"docker.io/*", "mirror.internal/dockerhub/*"},
+			image:                "docker.io/library/nginx:1.25",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/dockerhub/library/nginx:1.25"},
+		},
+		{
+			name:                 "docker hub short name",
+			equivalentRegistries: []string{"docker.io/*", "mirror.internal/dockerhub/*"},
+			image:                "nginx:1.25",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/dockerhub/library/nginx:1.25"},
+		},
+		{
+			name:                 "docker hub alias",
+			equivalentRegistries: []string{"index.docker.io", "mirror.internal/dockerhub"},
+			image:                "docker.io/bitnami/nginx:1.25",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/dockerhub/bitnami/nginx:1.25"},
+		},
+		{
+			name:                 "docker hub official image prefix",
+			equivalentRegistries: []string{"nginx", "mirror.internal/nginx"},
+			image:                "docker.io/library/nginx:1.25",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/nginx:1.25"},
+		},
+		{
+			name:                 "docker hub official image prefix with registry host",
+			equivalentRegistries: []string{"docker.io/nginx", "mirror.internal/nginx"},
+			image:                "nginx:1.25",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/nginx:1.25"},
+		},
+		{
+			name:                 "docker hub namespace prefix",
+			equivalentRegistries: []string{"docker.io/bitnami/*", "mirror.internal/bitnami/*"},
+			image:                "bitnami/redis:7",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/bitnami/redis:7"},
+		},
+		{
+			name:                 "docker hub namespace prefix without registry host",
+			equivalentRegistries: []string{"bitnami/*", "mirror.internal/bitnami/*"},
+			image:                "docker.io/bitnami/redis:7",
+			wantMatch:            true,
+			want:                 []string{"mirror.internal/bitnami/redis:7"},
+		},
+		{
+			name:                 "path prefix back to registry host",
+			equivalentRegistries: []string{"docker.io/*", "mirror.internal/dockerhub/*"},
+			image:                "mirror.internal/dockerhub/fairwinds/app@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+			wantMatch:            true,
+			want:                 []string{"docker.io/fairwinds/app@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"},
+		},
+		{
+			name:                 "prefixes without wildcards",
+			equivalentRegistries: []string{"quay.io/fairwinds", "registry.local:5000/fairwinds", "ghcr.io/fairwinds"},
+			image:                "quay.io/fairwinds/saffire:v1",
+			wantMatch:            true,
+			want:                 []string{"registry.local:5000/fairwinds/saffire:v1", "ghcr.io/fairwinds/saffire:v1"},
+		},
+		{
+			name:                 "prefix must end at a path separator",
+			equivalentRegistries: []string{"quay.io/fair", "ghcr.io/fair"},
+			image:                "quay.io/fairwinds/saffire:v1",
+			wantMatch:            false,
+		},
+		{
+			name:                 "different registry",
+			equivalentRegistries: []string{"docker.io/*", "mirror.internal/dockerhub/*"},
+			image:                "quay.io/fairwinds/saffire:v1",
+			wantMatch:            false,
+		},
+		{
+			name:                 "invalid mirror",
+			equivalentRegistries: []string{"docker.io/*", "not a registry/*"},
+			image:                "docker.io/library/nginx:1.25",
+			wantMatch:            true,
+			wantErr:              true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := newRegistryMirrorRule(tt.equivalentRegistries)
+			ref, err := parseImageReference(tt.image)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantMatch, rule.matches(ref))
+			if !tt.wantMatch {
+				return
+			}
+			got, err := rule.alternates(ref)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_patternRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   saffirev1alpha1.RepositoryPattern
+		image     string
+		wantMatch bool
+		want      []string
+	}{
+		{
+			name: "regex capture groups",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        `quay\.io/([^/]+)/([^/]+)`,
+				Replacements: []string{"ghcr.io/$1-mirror/$2"},
+			},
+			image:     "quay.io/fairwinds/saffire:v1",
+			wantMatch: true,
+			want:      []string{"ghcr.io/fairwinds-mirror/saffire:v1"},
+		},
+		{
+			name: "named groups",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        `quay\.io/(?P<org>[^/]+)/(?P<name>[^/]+)`,
+				Replacements: []string{"ghcr.io/${org}/mirror-${name}", "registry.local:5000/${name}"},
+			},
+			image:     "quay.io/fairwinds/saffire:v1",
+			wantMatch: true,
+			want:      []string{"ghcr.io/fairwinds/mirror-saffire:v1", "registry.local:5000/saffire:v1"},
+		},
+		{
+			name: "glob",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        "quay.io/*/*",
+				Syntax:       saffirev1alpha1.PatternSyntaxGlob,
+				Replacements: []string{"ghcr.io/${1}-mirror/${2}"},
+			},
+			image:     "quay.io/fairwinds/saffire@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+			wantMatch: true,
+			want:      []string{"ghcr.io/fairwinds-mirror/saffire@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"},
+		},
+		{
+			name: "glob across path components",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        "quay.io/**",
+				Syntax:       saffirev1alpha1.PatternSyntaxGlob,
+				Replacements: []string{"mirror.internal/quay/$1"},
+			},
+			image:     "quay.io/fairwinds/team/saffire:v1",
+			wantMatch: true,
+			want:      []string{"mirror.internal/quay/fairwinds/team/saffire:v1"},
+		},
+		{
+			name: "glob wildcard stays within a path component",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        "quay.io/*",
+				Syntax:       saffirev1alpha1.PatternSyntaxGlob,
+				Replacements: []string{"mirror.internal/$1"},
+			},
+			image:     "quay.io/fairwinds/saffire:v1",
+			wantMatch: false,
+		},
+		{
+			name: "normalized docker hub reference",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        `docker\.io/library/(.+)`,
+				Replacements: []string{"mirror.internal/dockerhub/$1"},
+			},
+			image:     "nginx:1.25",
+			wantMatch: true,
+			want:      []string{"mirror.internal/dockerhub/nginx:1.25"},
+		},
+		{
+			name: "match is anchored",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        `fairwinds/saffire`,
+				Replacements: []string{"ghcr.io/fairwinds/saffire"},
+			},
+			image:     "quay.io/fairwinds/saffire:v1",
+			wantMatch: false,
+		},
+		{
+			name: "replacement equal to the current repository is skipped",
+			pattern: saffirev1alpha1.RepositoryPattern{
+				Match:        `(quay\.io|ghcr\.io)/fairwinds/saffire`,
+				Replacements: []string{"quay.io/fairwinds/saffire", "ghcr.io/fairwinds/saffire"},
+			},
+			image:     "quay.io/fairwinds/saffire:v1",
+			wantMatch: true,
+			want:      []string{"ghcr.io/fairwinds/saffire:v1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := newPatternRule(tt.pattern)
+			assert.NoError(t, err)
+			ref, err := parseImageReference(tt.image)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantMatch, rule.matches(ref))
+			if !tt.wantMatch {
+				return
+			}
+			got, err := rule.alternates(ref)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_newPatternRule_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern saffirev1alpha1.RepositoryPattern
+	}{
+		{
+			name:    "no replacements",
+			pattern: saffirev1alpha1.RepositoryPattern{Match: "quay.io/(.*)"},
+		},
+		{
+			name:    "invalid regex",
+			pattern: saffirev1alpha1.RepositoryPattern{Match: "quay.io/(.*", Replacements: []string{"ghcr.io/$1"}},
+		},
+		{
+			name:    "unknown syntax",
+			pattern: saffirev1alpha1.RepositoryPattern{Match: "quay.io/*", Syntax: "Wildcard", Replacements: []string{"ghcr.io/$1"}},
+		},
+		{
+			name:    "group out of range",
+			pattern: saffirev1alpha1.RepositoryPattern{Match: "quay.io/(.*)", Replacements: []string{"ghcr.io/$2"}},
+		},
+		{
+			name:    "unknown named group",
+			pattern: saffirev1alpha1.RepositoryPattern{Match: "quay.io/(?P<name>.*)", Replacements: []string{"ghcr.io/${org}"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newPatternRule(tt.pattern)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_replacementRules(t *testing.T) {
+	spec := saffirev1alpha1.AlternateImageSourceSpec{
+		ImageSourceReplacements: []saffirev1alpha1.ImageSourceReplacement{
+			{EquivalentRepositories: []string{"quay.io/fairwinds/saffire", "ghcr.io/fairwinds/saffire"}},
+		},
+		RegistryMirrors: []saffirev1alpha1.RegistryMirror{
+			{EquivalentRegistries: []string{"docker.io/*", "mirror.internal/dockerhub/*"}},
+		},
+		RepositoryPatterns: []saffirev1alpha1.RepositoryPattern{
+			{Match: "quay.io/(.*)", Replacements: []string{"ghcr.io/$1"}},
+			{Match: "quay.io/(.*", Replacements: []string{"ghcr.io/$1"}},
+		},
+	}
+	rules, err := replacementRules(spec)
+	assert.Error(t, err)
+	assert.Len(t, rules, 3)
+}
+
+func Test_replacementRule_registries(t *testing.T) {
+	spec := saffirev1alpha1.AlternateImageSourceSpec{
+		ImageSourceReplacements: []saffirev1alpha1.ImageSourceReplacement{
+			{EquivalentRepositories: []string{"quay.io/fairwinds/saffire", "fairwinds/saffire", "quay.io/fairwinds/other"}},
+		},
+		RegistryMirrors: []saffirev1alpha1.RegistryMirror{
+			{EquivalentRegistries: []string{"docker.io/*", "index.docker.io/bitnami/*", "mirror.internal/dockerhub/*"}},
+		},
+		RepositoryPatterns: []saffirev1alpha1.RepositoryPattern{
+			{Match: "quay.io/(.*)", Replacements: []string{"ghcr.io/$1", "${1}-mirror/app", "$1", "fairwinds/$1", "Registry.Local:5000/${1}"}},
+		},
+	}
+	rules, err := replacementRules(spec)
+	assert.NoError(t, err)
+	want := [][]string{
+		{"quay.io", "docker.io"},
+		{"docker.io", "mirror.internal"},
+		{"ghcr.io", "docker.io", "registry.local:5000"},
+	}
+	for idx, rule := range rules {
+		assert.Equal(t, want[idx], rule.registries())
+	}
+}
+
+func Test_repositoryRule_tagTransform(t *testing.T) {
+	replacement := saffirev1alpha1.ImageSourceReplacement{
+		EquivalentRepositories: []string{
+			"quay.io/fairwinds/saffire",
+			"mirror.internal/fairwinds/saffire",
+			"registry.local:5000/saffire",
+		},
+		RepositoryOptions: []saffirev1alpha1.RepositoryOptions{
+			{
+				Repository:   "quay.io/fairwinds/saffire",
+				TagTransform: &saffirev1alpha1.TagTransform{Prefix: "v"},
+			},
+			{
+				Repository:   "mirror.internal/fairwinds/saffire",
+				TagTransform: &saffirev1alpha1.TagTransform{Suffix: "-mirror"},
+			},
+			{
+				Repository: "registry.local:5000/saffire",
+				TagTransform: &saffirev1alpha1.TagTransform{
+					Match:       `^(\d+)\.(\d+)\.(\d+)$`,
+					Replacement: "${1}.${2}",
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		image string
+		want  []string
+	}{
+		{
+			name:  "prefix to suffix and regex",
+			image: "quay.io/fairwinds/saffire:v1.2.3",
+			want:  []string{"mirror.internal/fairwinds/saffire:1.2.3-mirror", "registry.local:5000/saffire:1.2"},
+		},
+		{
+			name:  "suffix to prefix",
+			image: "mirror.internal/fairwinds/saffire:1.2.3-mirror",
+			want:  []string{"quay.io/fairwinds/saffire:v1.2.3", "registry.local:5000/saffire:1.2"},
+		},
+		{
+			name:  "implicit latest tag",
+			image: "quay.io/fairwinds/saffire",
+			want:  []string{"mirror.internal/fairwinds/saffire:latest-mirror", "registry.local:5000/saffire"},
+		},
+		{
+			name:  "digest only is left alone",
+			image: "quay.io/fairwinds/saffire@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+			want: []string{
+				"mirror.internal/fairwinds/saffire@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+				"registry.local:5000/saffire@sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b",
+			},
+		},
+	}
+	rule, err := newRepositoryRule(replacement)
+	assert.NoError(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := parseImageReference(tt.image)
+			assert.NoError(t, err)
+			got, err := rule.alternates(ref)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_newRepositoryRule_invalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		replacement saffirev1alpha1.ImageSourceReplacement
+	}{
+		{
+			name: "options for an unknown repository",
+			replacement: saffirev1alpha1.ImageSourceReplacement{
+				EquivalentRepositories: []string{"quay.io/fairwinds/saffire", "ghcr.io/fairwinds/saffire"},
+				RepositoryOptions: []saffirev1alpha1.RepositoryOptions{
+					{Repository: "docker.io/fairwinds/saffire", TagTransform: &saffirev1alpha1.TagTransform{Prefix: "v"}},
+				},
+			},
+		},
+		{
+			name: "invalid tag regex",
+			replacement: saffirev1alpha1.ImageSourceReplacement{
+				EquivalentRepositories: []string{"quay.io/fairwinds/saffire", "ghcr.io/fairwinds/saffire"},
+				RepositoryOptions: []saffirev1alpha1.RepositoryOptions{
+					{Repository: "ghcr.io/fairwinds/saffire", TagTransform: &saffirev1alpha1.TagTransform{Match: "(", Replacement: "$1"}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newRepositoryRule(tt.replacement)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_repositoryRule_pullSecret(t *testing.T) {
+	rule, err := newRepositoryRule(saffirev1alpha1.ImageSourceReplacement{
+		EquivalentRepositories: []string{"nginx", "mirror.internal/nginx"},
+		RepositoryOptions: []saffirev1alpha1.RepositoryOptions{
+			{Repository: "mirror.internal/nginx", ImagePullSecret: "mirror-credentials"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "mirror-credentials", pullSecretFor("mirror.internal/nginx:1.25", rule))
+	assert.Equal(t, "", pullSecretFor("docker.io/library/nginx:1.25", rule))
+}
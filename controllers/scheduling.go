@@ -0,0 +1,109 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// nodeSelectorOperators maps the operators of node selector requirements to label selector operators
+var nodeSelectorOperators = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+// canSchedule reports whether a pod can be scheduled to a node, by its nodeSelector, its required node affinity and
+// its tolerations of the node's NoSchedule and NoExecute taints
+func canSchedule(pod *corev1.Pod, node *corev1.Node) bool {
+	if !labels.SelectorFromSet(pod.Spec.NodeSelector).Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		if required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil && !matchesNodeSelector(required, node) {
+			return false
+		}
+	}
+	return toleratesTaints(pod.Spec.Tolerations, node.Spec.Taints)
+}
+
+// matchesNodeSelector reports whether a node matches any of the terms of a node selector
+func matchesNodeSelector(nodeSelector *corev1.NodeSelector, node *corev1.Node) bool {
+	for _, term := range nodeSelector.NodeSelectorTerms {
+		if matchesNodeSelectorTerm(term, node) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesNodeSelectorTerm reports whether a node matches every requirement of a node selector term. A term without
+// requirements matches no node
+func matchesNodeSelectorTerm(term corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+		return false
+	}
+	for _, expression := range term.MatchExpressions {
+		if !matchesRequirement(expression, node.Labels) {
+			return false
+		}
+	}
+	for _, field := range term.MatchFields {
+		// metadata.name is the only field that can be selected
+		if field.Key != "metadata.name" || !matchesRequirement(field, labels.Set{field.Key: node.Name}) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesRequirement reports whether a set of labels matches a node selector requirement
+func matchesRequirement(requirement corev1.NodeSelectorRequirement, set labels.Set) bool {
+	operator, ok := nodeSelectorOperators[requirement.Operator]
+	if !ok {
+		return false
+	}
+	selector, err := labels.NewRequirement(requirement.Key, operator, requirement.Values)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(set)
+}
+
+// toleratesTaints reports whether tolerations tolerate every taint that keeps pods from being scheduled
+func toleratesTaints(tolerations []corev1.Toleration, taints []corev1.Taint) bool {
+	for idx := range taints {
+		taint := &taints[idx]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for _, toleration := range tolerations {
+			if toleration.ToleratesTaint(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
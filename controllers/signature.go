@@ -0,0 +1,154 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// cosignSignatureAnnotation holds the base64 encoded signature of a cosign signature layer
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+// signatureManifest is the image manifest that cosign stores signatures in
+type signatureManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// simpleSigningPayload is the payload that cosign signs
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// parsePublicKey parses a PEM encoded ECDSA, RSA or Ed25519 public key
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// verifyCosignSignature checks that an image carries a cosign signature made with the private key of publicKey, and
+// returns the digest that the signature was verified for. A tag is resolved to its digest first.
+// Signatures are read from the sha256-<digest>.sig tag next to the image, and verified without a transparency log.
+func (c *RegistryClient) verifyCosignSignature(ctx context.Context, image string, publicKey crypto.PublicKey) (string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	digest := ref.digest
+	if digest == "" {
+		descriptor, err := c.headManifest(ctx, image)
+		if err != nil {
+			return "", err
+		}
+		digest = descriptor.digest
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("could not determine the digest of %s", image)
+	}
+
+	signatureImage := ref.repository() + ":" + strings.Replace(digest, ":", "-", 1) + ".sig"
+	_, body, err := c.getManifest(ctx, signatureImage)
+	if err != nil {
+		return "", fmt.Errorf("no signature found: %w", err)
+	}
+	var manifest signatureManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return "", fmt.Errorf("could not parse signature manifest: %w", err)
+	}
+
+	lastErr := fmt.Errorf("no signature found")
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		payload, err := c.getBlob(ctx, image, layer.Digest)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if lastErr = verifySignaturePayload(payload, layer.Digest, signature, digest, publicKey); lastErr == nil {
+			return digest, nil
+		}
+	}
+	return "", lastErr
+}
+
+// verifySignaturePayload verifies a single cosign signature over its payload, and that the payload signs the image digest
+func verifySignaturePayload(payload []byte, payloadDigest string, encodedSignature string, imageDigest string, publicKey crypto.PublicKey) error {
+	sum := sha256.Sum256(payload)
+	if payloadDigest != "sha256:"+hex.EncodeToString(sum[:]) {
+		return fmt.Errorf("signature payload does not match its digest")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return fmt.Errorf("could not decode signature: %w", err)
+	}
+
+	verified := false
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		verified = ecdsa.VerifyASN1(key, sum[:], signature)
+	case *rsa.PublicKey:
+		verified = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) == nil
+	case ed25519.PublicKey:
+		verified = ed25519.Verify(key, payload, signature)
+	}
+	if !verified {
+		return fmt.Errorf("signature does not verify against the public key")
+	}
+
+	var signed simpleSigningPayload
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("could not parse signature payload: %w", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != imageDigest {
+		return fmt.Errorf("signature is for %s, not %s", signed.Critical.Image.DockerManifestDigest, imageDigest)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const signedDigest = "sha256:9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b"
+
+// newSignedRegistry serves an image signed with key, in the layout that cosign uses
+func newSignedRegistry(t *testing.T, key *ecdsa.PrivateKey, signedFor string) string {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"saffire"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, signedFor))
+	sum := sha256.Sum256(payload)
+	payloadDigest := "sha256:" + hex.EncodeToString(sum[:])
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/saffire/manifests/v1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", signedDigest)
+	})
+	mux.HandleFunc("/v2/saffire/manifests/sha256-9d5e2e1f2e8d3c1b0a4f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e5d6c7b.sig", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"layers": [{"digest": "%s", "annotations": {"%s": "%s"}}]}`,
+			payloadDigest, cosignSignatureAnnotation, base64.StdEncoding.EncodeToString(signature))
+	})
+	mux.HandleFunc("/v2/saffire/blobs/"+payloadDigest, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(payload)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func encodePublicKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestRegistryClient_verifyCosignSignature(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	publicKey, err := parsePublicKey(encodePublicKey(t, signingKey))
+	assert.NoError(t, err)
+	otherPublicKey, err := parsePublicKey(encodePublicKey(t, otherKey))
+	assert.NoError(t, err)
+
+	host := newSignedRegistry(t, signingKey, signedDigest)
+	registry := NewRegistryClient([]string{host})
+	digest, err := registry.verifyCosignSignature(context.Background(), host+"/saffire:v1", publicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, signedDigest, digest)
+	digest, err = registry.verifyCosignSignature(context.Background(), host+"/saffire@"+signedDigest, publicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, signedDigest, digest)
+	_, err = registry.verifyCosignSignature(context.Background(), host+"/saffire:v1", otherPublicKey)
+	assert.Error(t, err)
+
+	wrongImageHost := newSignedRegistry(t, signingKey, "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	registry = NewRegistryClient([]string{wrongImageHost})
+	_, err = registry.verifyCosignSignature(context.Background(), wrongImageHost+"/saffire:v1", publicKey)
+	assert.Error(t, err)
+}
+
+func Test_pinnedImage(t *testing.T) {
+	assert.Equal(t, "quay.io/fairwinds/saffire:v1@"+signedDigest, pinnedImage("quay.io/fairwinds/saffire:v1", signedDigest))
+	assert.Equal(t, "quay.io/fairwinds/saffire@"+signedDigest, pinnedImage("quay.io/fairwinds/saffire@"+signedDigest, signedDigest))
+
+	tried := []string{pinnedImage("quay.io/fairwinds/saffire:v1", signedDigest)}
+	assert.True(t, wasTried(tried, "quay.io/fairwinds/saffire:v1"))
+	assert.False(t, wasTried(tried, "quay.io/fairwinds/saffire:v2"))
+}
+
+func Test_parsePublicKey(t *testing.T) {
+	_, err := parsePublicKey([]byte("not a key"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// thresholdCheckInterval is how often a target that has not met the failure thresholds is checked again
+const thresholdCheckInterval = 30 * time.Second
+
+// replicaPaths are the fields that hold how many pods a workload should have, in order of preference
+var replicaPaths = [][]string{
+	{"spec", "replicas"},
+	{"status", "desiredNumberScheduled"},
+	{"spec", "parallelism"},
+	{"spec", "jobTemplate", "spec", "parallelism"},
+}
+
+// failingTarget is a container of a target that is failing in one or more of its pods
+type failingTarget struct {
+	target saffirev1alpha1.Target
+	// pod is the first pod found failing, which the switch is made for
+	pod       *corev1.Pod
+	container failingContainer
+	// pods is how many pods are failing on the container
+	pods     int32
+	replicas int32
+	// lastPod is the name of the last pod counted, so a container reported twice is counted once
+	lastPod string
+}
+
+// failingTargetFor returns the failing target with the same container as target, or nil when there is none
+func failingTargetFor(failing []*failingTarget, target saffirev1alpha1.Target) *failingTarget {
+	for _, candidate := range failing {
+		if sameContainer(candidate.target, target) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// appendPendingSwitches adds the pending switches whose container is not pending already
+func appendPendingSwitches(pending []saffirev1alpha1.PendingSwitch, pendingSwitches []saffirev1alpha1.PendingSwitch) []saffirev1alpha1.PendingSwitch {
+	for _, pendingSwitch := range pendingSwitches {
+		if _, found := pendingSwitchFor(pending, pendingSwitch.Target); !found {
+			pending = append(pending, pendingSwitch)
+		}
+	}
+	return pending
+}
+
+// pendingSwitchFor returns the pending switch of the same container as target, and whether there is one
+func pendingSwitchFor(pending []saffirev1alpha1.PendingSwitch, target saffirev1alpha1.Target) (saffirev1alpha1.PendingSwitch, bool) {
+	for _, pendingSwitch := range pending {
+		if sameContainer(pendingSwitch.Target, target) {
+			return pendingSwitch, true
+		}
+	}
+	return saffirev1alpha1.PendingSwitch{}, false
+}
+
+// replicasOf returns how many pods a workload should have. Workloads without a replica count, such as pods, have one
+func replicasOf(controller *unstructured.Unstructured) int32 {
+	for _, path := range replicaPaths {
+		if replicas, found, err := unstructured.NestedInt64(controller.Object, path...); err == nil && found {
+			return int32(replicas)
+		}
+	}
+	return 1
+}
+
+// failingSince returns when a container of a target was first seen failing on an image, which is now unless it was
+// already pending
+func failingSince(pending []saffirev1alpha1.PendingSwitch, target saffirev1alpha1.Target, image string, now time.Time) metav1.Time {
+	if pendingSwitch, found := pendingSwitchFor(pending, target); found && pendingSwitch.Image == image {
+		return pendingSwitch.FailingSince
+	}
+	return metav1.NewTime(now)
+}
+
+// checkThresholds reports whether a failing target meets the failure thresholds of an AIS. When it does not, it
+// returns the pending switch to record and when to check the target again
+func checkThresholds(ais *saffirev1alpha1.AlternateImageSource, failing *failingTarget, now time.Time) (saffirev1alpha1.PendingSwitch, time.Duration, bool) {
+	policy := ais.Spec.Switching
+	replicas := failing.replicas
+	if replicas < failing.pods {
+		replicas = failing.pods
+	}
+	pendingSwitch := saffirev1alpha1.PendingSwitch{
+		Target:       failing.target,
+		Image:        failing.container.image,
+		Cause:        failing.container.failure.cause,
+		FailingPods:  failing.pods,
+		Replicas:     replicas,
+		FailingSince: failingSince(ais.Status.Pending, failing.target, failing.container.image, now),
+	}
+
+	unmet := []string{}
+	if failing.pods < policy.MinFailingPods {
+		unmet = append(unmet, fmt.Sprintf("%d of %d failing pods", failing.pods, policy.MinFailingPods))
+	}
+	if failing.pods*100 < policy.MinFailingPercent*replicas {
+		unmet = append(unmet, fmt.Sprintf("%d%% of replicas failing, %d%% required", failing.pods*100/replicas, policy.MinFailingPercent))
+	}
+	recheck := thresholdCheckInterval
+	if policy.MinFailureDuration != nil {
+		failingFor := now.Sub(pendingSwitch.FailingSince.Time)
+		if remaining := policy.MinFailureDuration.Duration - failingFor; remaining > 0 {
+			unmet = append(unmet, fmt.Sprintf("failing for %s of %s", failingFor.Round(time.Second), policy.MinFailureDuration.Duration))
+			recheck = remaining
+		}
+	}
+	if len(unmet) == 0 {
+		return saffirev1alpha1.PendingSwitch{}, 0, true
+	}
+	pendingSwitch.Message = "thresholds not met: " + strings.Join(unmet, ", ")
+	return pendingSwitch, recheck, false
+}
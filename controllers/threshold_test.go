@@ -0,0 +1,174 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_checkThresholds(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	target := saffirev1alpha1.Target{Name: "web", Container: "app", Type: metav1.GroupKind{Kind: "Deployment", Group: "apps/v1"}}
+	app := podContainer{name: "app", image: "quay.io/fairwinds/saffire:v1", containerType: saffirev1alpha1.ContainerTypeContainer}
+	tests := []struct {
+		name        string
+		policy      saffirev1alpha1.SwitchingPolicy
+		pending     []saffirev1alpha1.PendingSwitch
+		pods        int32
+		replicas    int32
+		wantMet     bool
+		wantMessage string
+		wantRecheck time.Duration
+		wantSince   time.Time
+	}{
+		{
+			name:     "no thresholds",
+			pods:     1,
+			replicas: 3,
+			wantMet:  true,
+		},
+		{
+			name:        "too few failing pods",
+			policy:      saffirev1alpha1.SwitchingPolicy{MinFailingPods: 2},
+			pods:        1,
+			replicas:    3,
+			wantMessage: "thresholds not met: 1 of 2 failing pods",
+			wantRecheck: thresholdCheckInterval,
+			wantSince:   now,
+		},
+		{
+			name:        "too few failing replicas",
+			policy:      saffirev1alpha1.SwitchingPolicy{MinFailingPercent: 50},
+			pods:        1,
+			replicas:    4,
+			wantMessage: "thresholds not met: 25% of replicas failing, 50% required",
+			wantRecheck: thresholdCheckInterval,
+			wantSince:   now,
+		},
+		{
+			name:     "enough failing replicas",
+			policy:   saffirev1alpha1.SwitchingPolicy{MinFailingPods: 2, MinFailingPercent: 50},
+			pods:     2,
+			replicas: 4,
+			wantMet:  true,
+		},
+		{
+			name:        "first seen failing",
+			policy:      saffirev1alpha1.SwitchingPolicy{MinFailureDuration: &metav1.Duration{Duration: 5 * time.Minute}},
+			pods:        1,
+			replicas:    1,
+			wantMessage: "thresholds not met: failing for 0s of 5m0s",
+			wantRecheck: 5 * time.Minute,
+			wantSince:   now,
+		},
+		{
+			name:   "failing for part of the duration",
+			policy: saffirev1alpha1.SwitchingPolicy{MinFailureDuration: &metav1.Duration{Duration: 5 * time.Minute}},
+			pending: []saffirev1alpha1.PendingSwitch{
+				{Target: target, Image: app.image, FailingSince: metav1.NewTime(now.Add(-2 * time.Minute))},
+			},
+			pods:        1,
+			replicas:    1,
+			wantMessage: "thresholds not met: failing for 2m0s of 5m0s",
+			wantRecheck: 3 * time.Minute,
+			wantSince:   now.Add(-2 * time.Minute),
+		},
+		{
+			name:   "failing on another image",
+			policy: saffirev1alpha1.SwitchingPolicy{MinFailureDuration: &metav1.Duration{Duration: 5 * time.Minute}},
+			pending: []saffirev1alpha1.PendingSwitch{
+				{Target: target, Image: "quay.io/fairwinds/saffire:v0", FailingSince: metav1.NewTime(now.Add(-10 * time.Minute))},
+			},
+			pods:        1,
+			replicas:    1,
+			wantMessage: "thresholds not met: failing for 0s of 5m0s",
+			wantRecheck: 5 * time.Minute,
+			wantSince:   now,
+		},
+		{
+			name:   "failing for the whole duration",
+			policy: saffirev1alpha1.SwitchingPolicy{MinFailureDuration: &metav1.Duration{Duration: 5 * time.Minute}},
+			pending: []saffirev1alpha1.PendingSwitch{
+				{Target: target, Image: app.image, FailingSince: metav1.NewTime(now.Add(-6 * time.Minute))},
+			},
+			pods:     1,
+			replicas: 1,
+			wantMet:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ais := &saffirev1alpha1.AlternateImageSource{}
+			ais.Spec.Switching = tt.policy
+			ais.Status.Pending = tt.pending
+			failing := &failingTarget{
+				target:    target,
+				container: failingContainer{app, pullFailure{cause: saffirev1alpha1.PullFailureCauseNetwork}},
+				pods:      tt.pods,
+				replicas:  tt.replicas,
+			}
+			pendingSwitch, recheck, met := checkThresholds(ais, failing, now)
+			assert.Equal(t, tt.wantMet, met)
+			assert.Equal(t, tt.wantRecheck, recheck)
+			if !tt.wantMet {
+				assert.Equal(t, tt.wantMessage, pendingSwitch.Message)
+				assert.Equal(t, tt.pods, pendingSwitch.FailingPods)
+				assert.Equal(t, tt.replicas, pendingSwitch.Replicas)
+				assert.True(t, tt.wantSince.Equal(pendingSwitch.FailingSince.Time))
+			}
+		})
+	}
+}
+
+func Test_replicasOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		object map[string]interface{}
+		want   int32
+	}{
+		{
+			name:   "deployment",
+			object: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(3)}},
+			want:   3,
+		},
+		{
+			name:   "daemonset",
+			object: map[string]interface{}{"spec": map[string]interface{}{}, "status": map[string]interface{}{"desiredNumberScheduled": int64(5)}},
+			want:   5,
+		},
+		{
+			name:   "cronjob",
+			object: map[string]interface{}{"spec": map[string]interface{}{"jobTemplate": map[string]interface{}{"spec": map[string]interface{}{"parallelism": int64(2)}}}},
+			want:   2,
+		},
+		{
+			name:   "pod",
+			object: map[string]interface{}{"spec": map[string]interface{}{"containers": []interface{}{}}},
+			want:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, replicasOf(&unstructured.Unstructured{Object: tt.object}))
+		})
+	}
+}
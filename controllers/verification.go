@@ -0,0 +1,343 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/thoas/go-funk"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// selectAlternate returns the first alternate image for a pod's image that was not tried before, whose registry did not
+// fail its health probe, and that passes verification, along with each alternate that was rejected on the way. The
+// image is empty when every alternate was rejected.
+func (r *AlternateImageSourceReconciler) selectAlternate(ais *saffirev1alpha1.AlternateImageSource, pod *corev1.Pod, image string, rule replacementRule, tried []string) (string, []saffirev1alpha1.RejectedImage, error) {
+	alternates, err := getAlternateImages(image, rule)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ctx := context.Background()
+	var platforms []platform
+	var podSecrets []string
+	if r.Registry != nil {
+		if !ais.Spec.Verification.SkipPlatformCheck {
+			platforms, err = r.requiredPlatforms(ctx, pod)
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		podSecrets, err = r.podPullSecrets(ctx, pod)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var rejected []saffirev1alpha1.RejectedImage
+	for _, alternate := range alternates {
+		if wasTried(tried, alternate) {
+			rejected = append(rejected, saffirev1alpha1.RejectedImage{Image: alternate, Reason: "already tried for this container"})
+			continue
+		}
+		if reason, unavailable := r.probeFailure(alternate); unavailable {
+			rejected = append(rejected, saffirev1alpha1.RejectedImage{Image: alternate, Reason: reason})
+			continue
+		}
+		pullSecrets := append([]string{pullSecretFor(alternate, rule)}, podSecrets...)
+		verified, err := r.verifyAlternate(ctx, ais, alternate, pullSecrets, platforms)
+		if err != nil {
+			r.Log.Info("rejecting alternate image", "image", alternate, "reason", err.Error())
+			rejected = append(rejected, saffirev1alpha1.RejectedImage{Image: alternate, Reason: err.Error()})
+			continue
+		}
+		return verified, rejected, nil
+	}
+	return "", rejected, nil
+}
+
+// verifyAlternate returns the image to switch to for an alternate image, or an error describing why it must not be
+// switched to. When its signature is verified, the image is pinned to the verified digest, so that the kubelet pulls
+// what was verified even if the tag moves. The registry is queried with the credentials of the first image pull
+// secret that has some for it. When the registry denies them, the manifest and platforms cannot be checked, so the
+// image is not rejected for them
+func (r *AlternateImageSourceReconciler) verifyAlternate(ctx context.Context, ais *saffirev1alpha1.AlternateImageSource, image string, pullSecrets []string, platforms []platform) (string, error) {
+	if r.Registry == nil {
+		if ais.Spec.Verification.Signature != nil {
+			meta.SetStatusCondition(&ais.Status.Conditions, v1.Condition{
+				Type:               saffirev1alpha1.ConditionSignatureVerified,
+				Status:             v1.ConditionFalse,
+				Reason:             "VerificationFailed",
+				Message:            fmt.Sprintf("%s: no registry client to verify the signature with", image),
+				ObservedGeneration: ais.Generation,
+			})
+			return "", fmt.Errorf("signature verification failed: no registry client to verify the signature with")
+		}
+		return image, nil
+	}
+
+	registry, err := r.registryFor(ctx, ais.Namespace, image, pullSecrets)
+	if err != nil {
+		return "", fmt.Errorf("could not read image pull secrets: %w", err)
+	}
+
+	if !ais.Spec.Verification.SkipManifestCheck {
+		if _, err := registry.headManifest(ctx, image); err != nil {
+			switch {
+			case errors.Is(err, errManifestUnknown):
+				return "", fmt.Errorf("tag or digest was not found in the alternate registry")
+			case errors.Is(err, errUnauthorized):
+				r.Log.Info("could not verify alternate image", "image", image, "reason", err.Error())
+				platforms = nil
+			default:
+				return "", fmt.Errorf("could not check the alternate registry: %w", err)
+			}
+		}
+	}
+
+	if ais.Spec.Verification.Signature != nil {
+		digest, err := r.verifySignature(ctx, registry, ais, image)
+		if err != nil {
+			meta.SetStatusCondition(&ais.Status.Conditions, v1.Condition{
+				Type:               saffirev1alpha1.ConditionSignatureVerified,
+				Status:             v1.ConditionFalse,
+				Reason:             "VerificationFailed",
+				Message:            fmt.Sprintf("%s: %s", image, err.Error()),
+				ObservedGeneration: ais.Generation,
+			})
+			return "", fmt.Errorf("signature verification failed: %w", err)
+		}
+		image = pinnedImage(image, digest)
+		meta.SetStatusCondition(&ais.Status.Conditions, v1.Condition{
+			Type:               saffirev1alpha1.ConditionSignatureVerified,
+			Status:             v1.ConditionTrue,
+			Reason:             "Verified",
+			Message:            image,
+			ObservedGeneration: ais.Generation,
+		})
+	}
+
+	if len(platforms) > 0 {
+		available, err := registry.platforms(ctx, image)
+		if errors.Is(err, errUnauthorized) {
+			r.Log.Info("could not verify the platforms of alternate image", "image", image, "reason", err.Error())
+			return image, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not check the platforms of the alternate image: %w", err)
+		}
+		if missing := missingPlatforms(platforms, available); len(missing) > 0 {
+			names := []string{}
+			for _, p := range missing {
+				names = append(names, p.String())
+			}
+			return "", fmt.Errorf("alternate image is not available for %s", strings.Join(names, ", "))
+		}
+	}
+	return image, nil
+}
+
+// registryFor returns the registry client to query an image with, authenticated with the first image pull secret
+// that has credentials for its registry. Empty names and secrets that do not exist are skipped
+func (r *AlternateImageSourceReconciler) registryFor(ctx context.Context, namespace string, image string, pullSecrets []string) (*RegistryClient, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	for _, pullSecret := range pullSecrets {
+		if pullSecret == "" {
+			continue
+		}
+		var secret corev1.Secret
+		if err := r.apiReader().Get(ctx, client.ObjectKey{Namespace: namespace, Name: pullSecret}, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		credentials, ok, err := credentialsFromSecret(&secret, ref.normalized().domain)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return r.Registry.withCredentials(credentials), nil
+		}
+	}
+	return r.Registry, nil
+}
+
+// podPullSecrets returns the names of the image pull secrets of a pod, followed by those of its service account
+func (r *AlternateImageSourceReconciler) podPullSecrets(ctx context.Context, pod *corev1.Pod) ([]string, error) {
+	names := []string{}
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		names = append(names, secret.Name)
+	}
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	var serviceAccount corev1.ServiceAccount
+	err := r.apiReader().Get(ctx, client.ObjectKey{Namespace: pod.Namespace, Name: serviceAccountName}, &serviceAccount)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	for _, secret := range serviceAccount.ImagePullSecrets {
+		if !funk.ContainsString(names, secret.Name) {
+			names = append(names, secret.Name)
+		}
+	}
+	return names, nil
+}
+
+// apiReader returns the reader for secrets, configmaps and service accounts, which are read without a cache
+func (r *AlternateImageSourceReconciler) apiReader() client.Reader {
+	if r.APIReader == nil {
+		return r.Client
+	}
+	return r.APIReader
+}
+
+// verifySignature checks the cosign signature of an image against the public key of the AlternateImageSource, and
+// returns the digest that it verified
+func (r *AlternateImageSourceReconciler) verifySignature(ctx context.Context, registry *RegistryClient, ais *saffirev1alpha1.AlternateImageSource, image string) (string, error) {
+	keyData, err := r.readKey(ctx, ais.Namespace, ais.Spec.Verification.Signature.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("could not read public key: %w", err)
+	}
+	publicKey, err := parsePublicKey(keyData)
+	if err != nil {
+		return "", fmt.Errorf("could not parse public key: %w", err)
+	}
+	return registry.verifyCosignSignature(ctx, image, publicKey)
+}
+
+// pinnedImage returns an image pinned to a digest, keeping its tag, as repository:tag@digest
+func pinnedImage(image string, digest string) string {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return image
+	}
+	ref.digest = digest
+	return ref.String()
+}
+
+// readKey returns the data selected by a KeyReference
+func (r *AlternateImageSourceReconciler) readKey(ctx context.Context, namespace string, ref saffirev1alpha1.KeyReference) ([]byte, error) {
+	switch {
+	case ref.SecretKeyRef != nil:
+		var secret corev1.Secret
+		if err := r.apiReader().Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.SecretKeyRef.Name}, &secret); err != nil {
+			return nil, err
+		}
+		data, ok := secret.Data[ref.SecretKeyRef.Key]
+		if !ok {
+			return nil, fmt.Errorf("secret %s has no key %s", ref.SecretKeyRef.Name, ref.SecretKeyRef.Key)
+		}
+		return data, nil
+	case ref.ConfigMapKeyRef != nil:
+		var configMap corev1.ConfigMap
+		if err := r.apiReader().Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.ConfigMapKeyRef.Name}, &configMap); err != nil {
+			return nil, err
+		}
+		data, ok := configMap.Data[ref.ConfigMapKeyRef.Key]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s has no key %s", ref.ConfigMapKeyRef.Name, ref.ConfigMapKeyRef.Key)
+		}
+		return []byte(data), nil
+	default:
+		return nil, fmt.Errorf("neither a secret nor a configmap is selected")
+	}
+}
+
+// requiredPlatforms returns the platforms of the node that a pod is scheduled to, and of every node that its
+// nodeSelector, required node affinity and tolerations allow it to be scheduled to
+func (r *AlternateImageSourceReconciler) requiredPlatforms(ctx context.Context, pod *corev1.Pod) ([]platform, error) {
+	var candidates corev1.NodeList
+	if err := r.List(ctx, &candidates, client.MatchingLabels(pod.Spec.NodeSelector)); err != nil {
+		return nil, err
+	}
+	nodes := []corev1.Node{}
+	for idx := range candidates.Items {
+		node := &candidates.Items[idx]
+		if node.Name == pod.Spec.NodeName || canSchedule(pod, node) {
+			nodes = append(nodes, *node)
+		}
+	}
+	if pod.Spec.NodeName != "" && !nodeListed(nodes, pod.Spec.NodeName) {
+		var node corev1.Node
+		err := r.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, &node)
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		if err == nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	platforms := []platform{}
+	for _, node := range nodes {
+		nodePlatform := platform{
+			os:           node.Labels[corev1.LabelOSStable],
+			architecture: node.Labels[corev1.LabelArchStable],
+		}
+		if nodePlatform.os == "" || nodePlatform.architecture == "" {
+			continue
+		}
+		if !platformListed(platforms, nodePlatform) {
+			platforms = append(platforms, nodePlatform)
+		}
+	}
+	return platforms, nil
+}
+
+// nodeListed reports whether a node is in a list of nodes
+func nodeListed(nodes []corev1.Node, name string) bool {
+	for _, node := range nodes {
+		if node.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// missingPlatforms returns the required platforms that are not available
+func missingPlatforms(required []platform, available []platform) []platform {
+	missing := []platform{}
+	for _, p := range required {
+		if !platformListed(available, p) {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// platformListed reports whether a platform is in a list of platforms
+func platformListed(platforms []platform, p platform) bool {
+	for _, listed := range platforms {
+		if listed == p {
+			return true
+		}
+	}
+	return false
+}
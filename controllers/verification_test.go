@@ -0,0 +1,224 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_missingPlatforms(t *testing.T) {
+	amd64 := platform{os: "linux", architecture: "amd64"}
+	arm64 := platform{os: "linux", architecture: "arm64"}
+
+	assert.Empty(t, missingPlatforms([]platform{amd64, arm64}, []platform{arm64, amd64}))
+	assert.Equal(t, []platform{arm64}, missingPlatforms([]platform{amd64, arm64}, []platform{amd64}))
+	assert.Empty(t, missingPlatforms(nil, []platform{amd64}))
+}
+
+// newPrivateRegistry serves a registry whose token service only hands out tokens for the user saffire
+func newPrivateRegistry(t *testing.T) string {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "saffire" || password != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "secret"}`)
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/private/app/manifests/v1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestAlternateImageSourceReconciler_verifyAlternate_pullSecrets(t *testing.T) {
+	host := newPrivateRegistry(t)
+	pullSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "private"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(fmt.Sprintf(`{"auths": {%q: {"username": "saffire", "password": "hunter2"}}}`, host)),
+		},
+	}
+	serviceAccount := &corev1.ServiceAccount{
+		ObjectMeta:       metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "private"}, {Name: "other"}},
+	}
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "saffire"}}
+
+	tests := []struct {
+		name    string
+		pod     corev1.PodSpec
+		image   string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "pod secrets",
+			pod:   corev1.PodSpec{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "missing"}, {Name: "private"}}},
+			image: host + "/private/app:v1",
+			want:  []string{"missing", "private"},
+		},
+		{
+			name:    "service account secrets",
+			pod:     corev1.PodSpec{ServiceAccountName: "app"},
+			image:   host + "/private/app:v2",
+			want:    []string{"private", "other"},
+			wantErr: "tag or digest was not found in the alternate registry",
+		},
+		{
+			name:  "no credentials cannot be verified",
+			image: host + "/private/app:v2",
+			want:  []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeReconciler(pullSecret, serviceAccount)
+			r.Registry = NewRegistryClient([]string{host})
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}, Spec: tt.pod}
+
+			pullSecrets, err := r.podPullSecrets(context.Background(), pod)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, pullSecrets)
+
+			_, err = r.verifyAlternate(context.Background(), ais, tt.image, pullSecrets, nil)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAlternateImageSourceReconciler_verifyAlternate_noRegistry(t *testing.T) {
+	r := newFakeReconciler()
+
+	ais := &saffirev1alpha1.AlternateImageSource{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "saffire"}}
+	image, err := r.verifyAlternate(context.Background(), ais, "quay.io/app:v1", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "quay.io/app:v1", image)
+	assert.Empty(t, ais.Status.Conditions)
+
+	ais.Spec.Verification.Signature = &saffirev1alpha1.SignaturePolicy{}
+	image, err = r.verifyAlternate(context.Background(), ais, "quay.io/app:v1", nil, nil)
+	assert.EqualError(t, err, "signature verification failed: no registry client to verify the signature with")
+	assert.Empty(t, image)
+	condition := meta.FindStatusCondition(ais.Status.Conditions, saffirev1alpha1.ConditionSignatureVerified)
+	if assert.NotNil(t, condition) {
+		assert.Equal(t, metav1.ConditionFalse, condition.Status)
+		assert.Equal(t, "quay.io/app:v1: no registry client to verify the signature with", condition.Message)
+	}
+}
+
+func TestAlternateImageSourceReconciler_requiredPlatforms(t *testing.T) {
+	node := func(name string, os string, arch string, taints ...corev1.Taint) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{
+				corev1.LabelOSStable:   os,
+				corev1.LabelArchStable: arch,
+				"pool":                 name,
+			}},
+			Spec: corev1.NodeSpec{Taints: taints},
+		}
+	}
+	armTaint := corev1.Taint{Key: "arch", Value: "arm64", Effect: corev1.TaintEffectNoSchedule}
+	nodes := []*corev1.Node{
+		node("linux-amd64", "linux", "amd64"),
+		node("linux-arm64", "linux", "arm64", armTaint),
+		node("windows-amd64", "windows", "amd64"),
+	}
+	linuxOnly := &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+			MatchExpressions: []corev1.NodeSelectorRequirement{{Key: corev1.LabelOSStable, Operator: corev1.NodeSelectorOpIn, Values: []string{"linux"}}},
+		}}},
+	}}
+	amd64 := platform{os: "linux", architecture: "amd64"}
+	arm64 := platform{os: "linux", architecture: "arm64"}
+	windows := platform{os: "windows", architecture: "amd64"}
+
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want []platform
+	}{
+		{
+			name: "untainted nodes",
+			want: []platform{amd64, windows},
+		},
+		{
+			name: "node selector",
+			spec: corev1.PodSpec{NodeSelector: map[string]string{"pool": "windows-amd64"}},
+			want: []platform{windows},
+		},
+		{
+			name: "required node affinity",
+			spec: corev1.PodSpec{Affinity: linuxOnly},
+			want: []platform{amd64},
+		},
+		{
+			name: "tolerated taint",
+			spec: corev1.PodSpec{
+				Affinity:    linuxOnly,
+				Tolerations: []corev1.Toleration{{Key: "arch", Operator: corev1.TolerationOpEqual, Value: "arm64", Effect: corev1.TaintEffectNoSchedule}},
+			},
+			want: []platform{amd64, arm64},
+		},
+		{
+			name: "scheduled node",
+			spec: corev1.PodSpec{Affinity: linuxOnly, NodeName: "linux-arm64"},
+			want: []platform{amd64, arm64},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []client.Object{}
+			for _, n := range nodes {
+				objects = append(objects, n.DeepCopy())
+			}
+			r := newFakeReconciler(objects...)
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"}, Spec: tt.spec}
+			platforms, err := r.requiredPlatforms(context.Background(), pod)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tt.want, platforms)
+		})
+	}
+}
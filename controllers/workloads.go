@@ -0,0 +1,388 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+// templatePodSpecPath is the path to the pod spec of workloads with a pod template
+var templatePodSpecPath = []string{"spec", "template", "spec"}
+
+// jobTemplatePodSpecPath is the path to the pod spec of a CronJob
+var jobTemplatePodSpecPath = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+
+// updateReplicaSet switches the pod template of a ReplicaSet that is not managed by a Deployment. A ReplicaSet does not
+// replace its pods on a template change, so the pods failing on the old image are deleted to be recreated from the new
+// template.
+func (r *AlternateImageSourceReconciler) updateReplicaSet(replicaSet *appsv1.ReplicaSet, switches []*saffirev1alpha1.SwitchStatus) error {
+	patched, err := r.patchPodSpec(replicaSet, templatePodSpecPath, func() *corev1.PodSpec { return &replicaSet.Spec.Template.Spec }, switchChange(switches))
+	if err != nil || !patched {
+		return err
+	}
+
+	failing, err := r.podsFailingOn(replicaSet.Namespace, replicaSet.UID, switches)
+	if err != nil {
+		return err
+	}
+	if len(failing) == 0 {
+		return nil
+	}
+	if err := r.deletePods(failing); err != nil {
+		return err
+	}
+	addMessage(switches, recreatedMessage(failing))
+	return nil
+}
+
+// updatePod switches the images of a pod without owners in place. The image pull secrets of a pod cannot be changed,
+// so a secret that the new repository needs is only reported.
+func (r *AlternateImageSourceReconciler) updatePod(pod *corev1.Pod, switches []*saffirev1alpha1.SwitchStatus) error {
+	switchImages := func(podSpec *corev1.PodSpec) bool {
+		changed := false
+		for _, switchStatus := range switches {
+			if switchContainerImage(podSpec, switchStatus) {
+				changed = true
+			}
+		}
+		return changed
+	}
+	patched, err := r.patchPodSpec(pod, []string{"spec"}, func() *corev1.PodSpec { return &pod.Spec }, switchImages)
+	if err != nil || !patched {
+		return err
+	}
+	for _, switchStatus := range switches {
+		if switchStatus.NewImagePullSecret != "" && !hasImagePullSecret(&pod.Spec, switchStatus.NewImagePullSecret) {
+			switchStatus.Message = fmt.Sprintf("image pull secret %s cannot be added to the running pod", switchStatus.NewImagePullSecret)
+		}
+	}
+	return nil
+}
+
+// updateStatefulSet switches the pod template of a StatefulSet.
+// A StatefulSet does not replace its pods on a template change with the OnDelete strategy, and its ordered rolling
+// update waits for failing pods to become ready, so the failing pods are deleted to be recreated from the new template.
+// Pods below the partition of a rolling update are recreated from the old template, so they are left alone.
+func (r *AlternateImageSourceReconciler) updateStatefulSet(statefulSet *appsv1.StatefulSet, switches []*saffirev1alpha1.SwitchStatus) error {
+	patched, err := r.patchPodSpec(statefulSet, templatePodSpecPath, func() *corev1.PodSpec { return &statefulSet.Spec.Template.Spec }, switchChange(switches))
+	if err != nil || !patched {
+		return err
+	}
+
+	failing, err := r.podsFailingOn(statefulSet.Namespace, statefulSet.UID, switches)
+	if err != nil {
+		return err
+	}
+	held, replace := splitByPartition(statefulSet, failing)
+	if err := r.deletePods(replace); err != nil {
+		return err
+	}
+
+	messages := []string{}
+	if len(replace) > 0 {
+		messages = append(messages, recreatedMessage(replace))
+	}
+	if len(held) > 0 {
+		messages = append(messages, fmt.Sprintf("pods %s are below the partition %d and keep the old image", strings.Join(podNames(held), ", "), statefulSetPartition(statefulSet)))
+	}
+	if len(messages) > 0 {
+		addMessage(switches, strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// updateDaemonSet switches the pod template of a DaemonSet. A rolling update replaces the failing pods on its own.
+// With the OnDelete strategy the pods stuck in ImagePullBackOff on the old image are deleted when deleteFailingPods is
+// set, so they are recreated with the new image.
+func (r *AlternateImageSourceReconciler) updateDaemonSet(daemonSet *appsv1.DaemonSet, switches []*saffirev1alpha1.SwitchStatus, deleteFailingPods bool) error {
+	patched, err := r.patchPodSpec(daemonSet, templatePodSpecPath, func() *corev1.PodSpec { return &daemonSet.Spec.Template.Spec }, switchChange(switches))
+	if err != nil || !patched {
+		return err
+	}
+	if daemonSet.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
+		return nil
+	}
+
+	failing, err := r.failingPodsOf(daemonSet.Namespace, daemonSet.UID)
+	if err != nil {
+		return err
+	}
+	stuck := []corev1.Pod{}
+	for _, pod := range failing {
+		for _, switchStatus := range switches {
+			if podIsInImagePullBackOff(&pod, switchStatus.OldImage) {
+				stuck = append(stuck, pod)
+				break
+			}
+		}
+	}
+	if len(stuck) == 0 {
+		return nil
+	}
+	if !deleteFailingPods {
+		addMessage(switches, fmt.Sprintf("pods %s keep the old image until they are deleted", strings.Join(podNames(stuck), ", ")))
+		return nil
+	}
+	if err := r.deletePods(stuck); err != nil {
+		return err
+	}
+	addMessage(switches, recreatedMessage(stuck))
+	return nil
+}
+
+// updateCronJob switches the job template of a CronJob, so that its next runs use the new image.
+// The Job run that is already failing keeps the old image.
+func (r *AlternateImageSourceReconciler) updateCronJob(cronJob *batchv1.CronJob, switches []*saffirev1alpha1.SwitchStatus) error {
+	patched, err := r.patchPodSpec(cronJob, jobTemplatePodSpecPath, func() *corev1.PodSpec { return &cronJob.Spec.JobTemplate.Spec.Template.Spec }, switchChange(switches))
+	if err != nil || !patched {
+		return err
+	}
+	for _, switchStatus := range switches {
+		if switchStatus.OldJob != "" {
+			switchStatus.Message = fmt.Sprintf("job %s keeps the old image, the next run uses the new image", switchStatus.OldJob)
+		}
+	}
+	return nil
+}
+
+// recreateJob replaces a Job with a copy that uses the new image, since the pod template of a Job cannot be changed.
+// The copy is created before the Job and its pods are deleted, so a failure leaves the Job in place.
+func (r *AlternateImageSourceReconciler) recreateJob(job *batchv1.Job, switches []*saffirev1alpha1.SwitchStatus) error {
+	newJob, ok := recreatedJob(job, switches)
+	if !ok {
+		return nil
+	}
+	ctx := context.Background()
+	if err := r.Create(ctx, newJob); err != nil {
+		return err
+	}
+	for _, switchStatus := range switches {
+		switchStatus.OldJob = job.Name
+		switchStatus.NewJob = newJob.Name
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)))
+}
+
+// recreatedJob returns a copy of a Job that uses the new images of the switches, or false when the Job does not use
+// any of the old images. The selector and labels that were generated for the Job are dropped, so they are generated again.
+func recreatedJob(job *batchv1.Job, switches []*saffirev1alpha1.SwitchStatus) (*batchv1.Job, bool) {
+	spec := job.Spec.DeepCopy()
+	if !applySwitches(&spec.Template.Spec, switches) {
+		return nil, false
+	}
+	if spec.ManualSelector == nil || !*spec.ManualSelector {
+		spec.Selector = nil
+		spec.Template.Labels = withoutGeneratedJobLabels(spec.Template.Labels)
+	}
+
+	prefix := job.Name
+	if len(prefix) > maxJobGenerateNameLength {
+		prefix = prefix[:maxJobGenerateNameLength]
+	}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: prefix + "-",
+			Namespace:    job.Namespace,
+			Labels:       withoutGeneratedJobLabels(job.Labels),
+			Annotations:  job.Annotations,
+		},
+		Spec: *spec,
+	}, true
+}
+
+// maxJobGenerateNameLength keeps the name of a recreated Job, including its random suffix, a valid label value
+const maxJobGenerateNameLength = 57
+
+// generatedJobLabels are the labels that the Job controller adds to a Job and its pod template
+var generatedJobLabels = []string{"controller-uid", "job-name", "batch.kubernetes.io/controller-uid", "batch.kubernetes.io/job-name"}
+
+// withoutGeneratedJobLabels returns a copy of labels without the labels that the Job controller generates
+func withoutGeneratedJobLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	result := map[string]string{}
+	for key, value := range labels {
+		result[key] = value
+	}
+	for _, key := range generatedJobLabels {
+		delete(result, key)
+	}
+	return result
+}
+
+// ownerName returns the name of the owner of a pod with the given kind, or an empty string when it has none
+func ownerName(pod *corev1.Pod, kind string) string {
+	for _, reference := range pod.OwnerReferences {
+		if reference.Kind == kind {
+			return reference.Name
+		}
+	}
+	return ""
+}
+
+// failingPodsOf lists the pods in a namespace that are owned by the given object and have image pull errors
+func (r *AlternateImageSourceReconciler) failingPodsOf(namespace string, owner types.UID) ([]corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	failing := []corev1.Pod{}
+	for _, pod := range pods.Items {
+		if !isOwnedBy(&pod, owner) || !r.podHasImagePullErr(&pod) {
+			continue
+		}
+		failing = append(failing, pod)
+	}
+	return failing, nil
+}
+
+// podsFailingOn lists the pods in a namespace that are owned by the given object and fail to pull the old image of a
+// switch in the container it targets. Pods failing only on other containers or images are left alone
+func (r *AlternateImageSourceReconciler) podsFailingOn(namespace string, owner types.UID, switches []*saffirev1alpha1.SwitchStatus) ([]corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := r.List(context.Background(), &pods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	failing := []corev1.Pod{}
+	for _, pod := range pods.Items {
+		if isOwnedBy(&pod, owner) && failsToPullOldImage(&pod, switches) {
+			failing = append(failing, pod)
+		}
+	}
+	return failing, nil
+}
+
+// failsToPullOldImage reports whether a container that a switch targets is in ErrImagePull or ImagePullBackOff on the
+// old image of the switch
+func failsToPullOldImage(pod *corev1.Pod, switches []*saffirev1alpha1.SwitchStatus) bool {
+	for _, container := range podContainers(&pod.Spec) {
+		status, ok := containerStatusOf(pod, container)
+		if !ok || status.State.Waiting == nil {
+			continue
+		}
+		if reason := status.State.Waiting.Reason; reason != "ErrImagePull" && reason != "ImagePullBackOff" {
+			continue
+		}
+		for _, switchStatus := range switches {
+			if container.name == switchStatus.Target.Container && container.containerType == targetContainerType(switchStatus.Target) && container.image == switchStatus.OldImage {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isOwnedBy reports whether a pod has an owner reference to the object with the given UID
+func isOwnedBy(pod *corev1.Pod, owner types.UID) bool {
+	for _, reference := range pod.OwnerReferences {
+		if reference.UID == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// podIsInImagePullBackOff reports whether a container of a pod that runs the image is in ImagePullBackOff
+func podIsInImagePullBackOff(pod *corev1.Pod, image string) bool {
+	for _, status := range podContainerStatuses(pod) {
+		if status.State.Waiting == nil || status.State.Waiting.Reason != "ImagePullBackOff" {
+			continue
+		}
+		for _, container := range podContainers(&pod.Spec) {
+			if container.name == status.Name && container.image == image {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// statefulSetPartition returns the partition of a StatefulSet's rolling update, or 0 when it has none
+func statefulSetPartition(statefulSet *appsv1.StatefulSet) int {
+	strategy := statefulSet.Spec.UpdateStrategy
+	if strategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return 0
+	}
+	if strategy.RollingUpdate == nil || strategy.RollingUpdate.Partition == nil {
+		return 0
+	}
+	return int(*strategy.RollingUpdate.Partition)
+}
+
+// splitByPartition splits the pods of a StatefulSet into those below the partition of its rolling update,
+// which keep the old template, and those that are recreated from the new template
+func splitByPartition(statefulSet *appsv1.StatefulSet, pods []corev1.Pod) ([]corev1.Pod, []corev1.Pod) {
+	partition := statefulSetPartition(statefulSet)
+	below := []corev1.Pod{}
+	updated := []corev1.Pod{}
+	for _, pod := range pods {
+		if ordinal, ok := podOrdinal(statefulSet.Name, pod.Name); ok && ordinal < partition {
+			below = append(below, pod)
+			continue
+		}
+		updated = append(updated, pod)
+	}
+	return below, updated
+}
+
+// podOrdinal returns the ordinal of a pod that is named after its StatefulSet
+func podOrdinal(statefulSetName string, podName string) (int, bool) {
+	prefix := statefulSetName + "-"
+	if !strings.HasPrefix(podName, prefix) {
+		return 0, false
+	}
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(podName, prefix))
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return ordinal, true
+}
+
+// deletePods deletes pods so that their controller recreates them
+func (r *AlternateImageSourceReconciler) deletePods(pods []corev1.Pod) error {
+	for idx := range pods {
+		if err := r.Delete(context.Background(), &pods[idx]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recreatedMessage describes the pods that were deleted to be recreated from the new template
+func recreatedMessage(pods []corev1.Pod) string {
+	return fmt.Sprintf("deleted failing pods %s to recreate them from the new template", strings.Join(podNames(pods), ", "))
+}
+
+// podNames returns the names of pods
+func podNames(pods []corev1.Pod) []string {
+	names := []string{}
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	return names
+}
@@ -0,0 +1,466 @@
+// Copyright 2020 FairwindsOps Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
+)
+
+func Test_splitByPartition(t *testing.T) {
+	partition := int32(2)
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "db-0"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "db-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "db-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "db-10"}},
+	}
+	tests := []struct {
+		name        string
+		strategy    appsv1.StatefulSetUpdateStrategy
+		wantBelow   []string
+		wantUpdated []string
+	}{
+		{
+			name:        "rolling update without partition",
+			strategy:    appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+			wantBelow:   []string{},
+			wantUpdated: []string{"db-0", "db-1", "db-2", "db-10"},
+		},
+		{
+			name: "partitioned rolling update",
+			strategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
+			wantBelow:   []string{"db-0", "db-1"},
+			wantUpdated: []string{"db-2", "db-10"},
+		},
+		{
+			name:        "on delete",
+			strategy:    appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+			wantBelow:   []string{},
+			wantUpdated: []string{"db-0", "db-1", "db-2", "db-10"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statefulSet := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "db"},
+				Spec:       appsv1.StatefulSetSpec{UpdateStrategy: tt.strategy},
+			}
+			below, updated := splitByPartition(statefulSet, pods)
+			assert.Equal(t, tt.wantBelow, podNames(below))
+			assert.Equal(t, tt.wantUpdated, podNames(updated))
+		})
+	}
+}
+
+func Test_podOrdinal(t *testing.T) {
+	tests := []struct {
+		name    string
+		podName string
+		want    int
+		wantOk  bool
+	}{
+		{name: "ordinal", podName: "db-3", want: 3, wantOk: true},
+		{name: "other set", podName: "cache-1", want: 0, wantOk: false},
+		{name: "not a number", podName: "db-abc", want: 0, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := podOrdinal("db", tt.podName)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOk, ok)
+		})
+	}
+}
+
+func Test_podIsInImagePullBackOff(t *testing.T) {
+	waiting := func(reason string) corev1.ContainerState {
+		return corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}
+	}
+	tests := []struct {
+		name  string
+		image string
+		state corev1.ContainerState
+		want  bool
+	}{
+		{name: "back off on the image", image: "quay.io/fairwinds/agent:v1", state: waiting("ImagePullBackOff"), want: true},
+		{name: "first pull error", image: "quay.io/fairwinds/agent:v1", state: waiting("ErrImagePull"), want: false},
+		{name: "back off on another image", image: "ghcr.io/fairwinds/agent:v1", state: waiting("ImagePullBackOff"), want: false},
+		{name: "running", image: "quay.io/fairwinds/agent:v1", state: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				Spec:   corev1.PodSpec{Containers: []corev1.Container{{Name: "agent", Image: "quay.io/fairwinds/agent:v1"}}},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{Name: "agent", State: tt.state}}},
+			}
+			assert.Equal(t, tt.want, podIsInImagePullBackOff(pod, tt.image))
+		})
+	}
+}
+
+func Test_recreatedJob(t *testing.T) {
+	switches := []*saffirev1alpha1.SwitchStatus{{
+		Target:   saffirev1alpha1.Target{Container: "migrate"},
+		OldImage: "quay.io/fairwinds/migrate:v1",
+		NewImage: "ghcr.io/fairwinds/migrate:v1",
+	}}
+	generated := map[string]string{
+		"app":                                "migrate",
+		"controller-uid":                     "1234",
+		"job-name":                           "migrate",
+		"batch.kubernetes.io/controller-uid": "1234",
+		"batch.kubernetes.io/job-name":       "migrate",
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "default", Labels: generated},
+		Spec: batchv1.JobSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "1234"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: generated},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "migrate", Image: "quay.io/fairwinds/migrate:v1"}},
+				},
+			},
+		},
+	}
+
+	got, ok := recreatedJob(job, switches)
+	assert.True(t, ok)
+	assert.Equal(t, "migrate-", got.GenerateName)
+	assert.Equal(t, "default", got.Namespace)
+	assert.Equal(t, map[string]string{"app": "migrate"}, got.Labels)
+	assert.Equal(t, map[string]string{"app": "migrate"}, got.Spec.Template.Labels)
+	assert.Nil(t, got.Spec.Selector)
+	assert.Equal(t, "ghcr.io/fairwinds/migrate:v1", got.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "quay.io/fairwinds/migrate:v1", job.Spec.Template.Spec.Containers[0].Image, "the original job is not modified")
+
+	manual := true
+	job.Spec.ManualSelector = &manual
+	got, ok = recreatedJob(job, switches)
+	assert.True(t, ok)
+	assert.Equal(t, job.Spec.Selector, got.Spec.Selector)
+	assert.Equal(t, generated, got.Spec.Template.Labels)
+
+	_, ok = recreatedJob(job, []*saffirev1alpha1.SwitchStatus{{
+		Target:   saffirev1alpha1.Target{Container: "migrate"},
+		OldImage: "quay.io/fairwinds/other:v1",
+		NewImage: "ghcr.io/fairwinds/other:v1",
+	}})
+	assert.False(t, ok)
+}
+
+// newOwnedPod returns a pod owned by the object with the given UID, whose only container waits for the reason
+func newOwnedPod(name string, owner types.UID, image string, reason string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "app", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}},
+		}},
+	}
+	if owner != "" {
+		pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "owner", UID: owner}}
+	}
+	return pod
+}
+
+// podExists reports whether a pod is still served by the client of a reconciler
+func podExists(t *testing.T, r *AlternateImageSourceReconciler, name string) bool {
+	err := r.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: name}, &corev1.Pod{})
+	if apierrors.IsNotFound(err) {
+		return false
+	}
+	assert.NoError(t, err)
+	return true
+}
+
+func TestAlternateImageSourceReconciler_updateReplicaSet(t *testing.T) {
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "rs-uid"},
+		Spec: appsv1.ReplicaSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/docker-demo:v1"}},
+		}}},
+	}
+	r := newFakeReconciler(
+		replicaSet,
+		newOwnedPod("web-failing", "rs-uid", "quay.io/fairwinds/docker-demo:v1", "ImagePullBackOff"),
+		newOwnedPod("web-creating", "rs-uid", "quay.io/fairwinds/docker-demo:v1", "ContainerCreating"),
+		newOwnedPod("other-failing", "other-uid", "quay.io/fairwinds/docker-demo:v1", "ImagePullBackOff"),
+		newOwnedPod("web-other-image", "rs-uid", "quay.io/fairwinds/docker-demo:v0", "ErrImagePull"),
+	)
+	switches := []*saffirev1alpha1.SwitchStatus{{
+		Target:   saffirev1alpha1.Target{Container: "app"},
+		OldImage: "quay.io/fairwinds/docker-demo:v1",
+		NewImage: "mirror.internal/fairwinds/docker-demo:v1",
+	}}
+
+	assert.NoError(t, r.updateReplicaSet(replicaSet.DeepCopy(), switches))
+
+	updated := &appsv1.ReplicaSet{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(replicaSet), updated))
+	assert.Equal(t, "mirror.internal/fairwinds/docker-demo:v1", updated.Spec.Template.Spec.Containers[0].Image)
+	assert.False(t, podExists(t, r, "web-failing"))
+	assert.True(t, podExists(t, r, "web-creating"))
+	assert.True(t, podExists(t, r, "other-failing"))
+	assert.True(t, podExists(t, r, "web-other-image"), "the pod fails on another image")
+	assert.Equal(t, "deleted failing pods web-failing to recreate them from the new template", switches[0].Message)
+
+	// the template already runs the new image, so nothing is patched or deleted again
+	r = newFakeReconciler(updated, newOwnedPod("web-failing", "rs-uid", "quay.io/fairwinds/docker-demo:v1", "ImagePullBackOff"))
+	switches[0].Message = ""
+	assert.NoError(t, r.updateReplicaSet(updated.DeepCopy(), switches))
+	assert.True(t, podExists(t, r, "web-failing"))
+	assert.Empty(t, switches[0].Message)
+}
+
+func TestAlternateImageSourceReconciler_updatePod(t *testing.T) {
+	tests := []struct {
+		name        string
+		pullSecret  string
+		wantMessage string
+	}{
+		{
+			name: "same pull secrets",
+		},
+		{
+			name:        "new pull secret",
+			pullSecret:  "mirror-credentials",
+			wantMessage: "image pull secret mirror-credentials cannot be added to the running pod",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newOwnedPod("web", "", "quay.io/fairwinds/docker-demo:v1", "ImagePullBackOff")
+			pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "quay-credentials"}}
+			r := newFakeReconciler(pod)
+			switches := []*saffirev1alpha1.SwitchStatus{{
+				Target:             saffirev1alpha1.Target{Container: "app"},
+				OldImage:           "quay.io/fairwinds/docker-demo:v1",
+				NewImage:           "mirror.internal/fairwinds/docker-demo:v1",
+				NewImagePullSecret: tt.pullSecret,
+			}}
+
+			assert.NoError(t, r.updatePod(pod.DeepCopy(), switches))
+
+			updated := &corev1.Pod{}
+			assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(pod), updated))
+			assert.Equal(t, "mirror.internal/fairwinds/docker-demo:v1", updated.Spec.Containers[0].Image)
+			assert.Equal(t, pod.Spec.ImagePullSecrets, updated.Spec.ImagePullSecrets)
+			assert.Equal(t, tt.wantMessage, switches[0].Message)
+		})
+	}
+}
+
+func TestAlternateImageSourceReconciler_updateStatefulSet(t *testing.T) {
+	partition := int32(2)
+	statefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", UID: "sts-uid"},
+		Spec: appsv1.StatefulSetSpec{
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{
+				Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+			},
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/db:v1"}},
+			}},
+		},
+	}
+	sidecarFailing := newOwnedPod("db-5", "sts-uid", "quay.io/fairwinds/db:v1", "ContainerCreating")
+	sidecarFailing.Spec.Containers = append(sidecarFailing.Spec.Containers, corev1.Container{Name: "metrics", Image: "quay.io/fairwinds/metrics:v1"})
+	sidecarFailing.Status.ContainerStatuses = append(sidecarFailing.Status.ContainerStatuses, corev1.ContainerStatus{
+		Name:  "metrics",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+	})
+	r := newFakeReconciler(
+		statefulSet,
+		newOwnedPod("db-0", "sts-uid", "quay.io/fairwinds/db:v1", "ContainerCreating"),
+		newOwnedPod("db-1", "sts-uid", "quay.io/fairwinds/db:v1", "ImagePullBackOff"),
+		newOwnedPod("db-2", "sts-uid", "quay.io/fairwinds/db:v1", "ImagePullBackOff"),
+		newOwnedPod("db-3", "sts-uid", "quay.io/fairwinds/db:v1", "ErrImagePull"),
+		newOwnedPod("db-4", "sts-uid", "quay.io/fairwinds/db:v0", "ImagePullBackOff"),
+		sidecarFailing,
+	)
+	switches := []*saffirev1alpha1.SwitchStatus{{
+		Target:   saffirev1alpha1.Target{Container: "app"},
+		OldImage: "quay.io/fairwinds/db:v1",
+		NewImage: "ghcr.io/fairwinds/db:v1",
+	}}
+
+	assert.NoError(t, r.updateStatefulSet(statefulSet.DeepCopy(), switches))
+
+	updated := &appsv1.StatefulSet{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(statefulSet), updated))
+	assert.Equal(t, "ghcr.io/fairwinds/db:v1", updated.Spec.Template.Spec.Containers[0].Image)
+	assert.True(t, podExists(t, r, "db-0"))
+	assert.True(t, podExists(t, r, "db-1"))
+	assert.False(t, podExists(t, r, "db-2"))
+	assert.False(t, podExists(t, r, "db-3"))
+	assert.True(t, podExists(t, r, "db-4"), "the pod fails on another image")
+	assert.True(t, podExists(t, r, "db-5"), "the pod fails on another container")
+	assert.Equal(t, "deleted failing pods db-2, db-3 to recreate them from the new template; pods db-1 are below the partition 2 and keep the old image", switches[0].Message)
+
+	// without failing pods there is nothing to add to the message
+	r = newFakeReconciler(statefulSet, newOwnedPod("db-0", "sts-uid", "quay.io/fairwinds/db:v1", "ContainerCreating"))
+	switches[0].Message = "Application argocd/db manages the target and will revert the switch on its next sync"
+	assert.NoError(t, r.updateStatefulSet(statefulSet.DeepCopy(), switches))
+	assert.Equal(t, "Application argocd/db manages the target and will revert the switch on its next sync", switches[0].Message)
+}
+
+func TestAlternateImageSourceReconciler_updateDaemonSet(t *testing.T) {
+	tests := []struct {
+		name              string
+		strategy          appsv1.DaemonSetUpdateStrategyType
+		deleteFailingPods bool
+		wantDeleted       bool
+		wantMessage       string
+	}{
+		{
+			name:     "rolling update",
+			strategy: appsv1.RollingUpdateDaemonSetStrategyType,
+		},
+		{
+			name:        "on delete keeps the pods",
+			strategy:    appsv1.OnDeleteDaemonSetStrategyType,
+			wantMessage: "pods agent-stuck keep the old image until they are deleted",
+		},
+		{
+			name:              "on delete deletes the stuck pods",
+			strategy:          appsv1.OnDeleteDaemonSetStrategyType,
+			deleteFailingPods: true,
+			wantDeleted:       true,
+			wantMessage:       "deleted failing pods agent-stuck to recreate them from the new template",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daemonSet := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default", UID: "ds-uid"},
+				Spec: appsv1.DaemonSetSpec{
+					UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: tt.strategy},
+					Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/agent:v1"}},
+					}},
+				},
+			}
+			r := newFakeReconciler(
+				daemonSet,
+				newOwnedPod("agent-stuck", "ds-uid", "quay.io/fairwinds/agent:v1", "ImagePullBackOff"),
+				newOwnedPod("agent-pulling", "ds-uid", "quay.io/fairwinds/agent:v1", "ErrImagePull"),
+			)
+			switches := []*saffirev1alpha1.SwitchStatus{{
+				Target:   saffirev1alpha1.Target{Container: "app"},
+				OldImage: "quay.io/fairwinds/agent:v1",
+				NewImage: "ghcr.io/fairwinds/agent:v1",
+			}}
+
+			assert.NoError(t, r.updateDaemonSet(daemonSet.DeepCopy(), switches, tt.deleteFailingPods))
+
+			updated := &appsv1.DaemonSet{}
+			assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(daemonSet), updated))
+			assert.Equal(t, "ghcr.io/fairwinds/agent:v1", updated.Spec.Template.Spec.Containers[0].Image)
+			assert.Equal(t, !tt.wantDeleted, podExists(t, r, "agent-stuck"))
+			assert.True(t, podExists(t, r, "agent-pulling"))
+			assert.Equal(t, tt.wantMessage, switches[0].Message)
+		})
+	}
+}
+
+func TestAlternateImageSourceReconciler_updateCronJob(t *testing.T) {
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "default"},
+		Spec: batchv1.CronJobSpec{
+			Schedule: "@hourly",
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "quay.io/fairwinds/report:v1"}},
+			}}}},
+		},
+	}
+	r := newFakeReconciler(cronJob)
+	switches := []*saffirev1alpha1.SwitchStatus{{
+		Target:   saffirev1alpha1.Target{Container: "app"},
+		OldImage: "quay.io/fairwinds/report:v1",
+		NewImage: "ghcr.io/fairwinds/report:v1",
+		OldJob:   "report-28000000",
+	}}
+
+	assert.NoError(t, r.updateCronJob(cronJob.DeepCopy(), switches))
+
+	updated := &batchv1.CronJob{}
+	assert.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(cronJob), updated))
+	assert.Equal(t, "ghcr.io/fairwinds/report:v1", updated.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "job report-28000000 keeps the old image, the next run uses the new image", switches[0].Message)
+}
+
+func TestAlternateImageSourceReconciler_recreateJob(t *testing.T) {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "default", Labels: map[string]string{"app": "migrate", "job-name": "migrate"}},
+		Spec: batchv1.JobSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "1234"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "migrate", "controller-uid": "1234"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "migrate", Image: "quay.io/fairwinds/migrate:v1"}},
+				},
+			},
+		},
+	}
+	r := newFakeReconciler(job)
+	switches := []*saffirev1alpha1.SwitchStatus{{
+		Target:   saffirev1alpha1.Target{Container: "migrate"},
+		OldImage: "quay.io/fairwinds/migrate:v1",
+		NewImage: "ghcr.io/fairwinds/migrate:v1",
+	}}
+
+	assert.NoError(t, r.recreateJob(job.DeepCopy(), switches))
+
+	jobs := &batchv1.JobList{}
+	assert.NoError(t, r.List(context.Background(), jobs, client.InNamespace("default")))
+	if assert.Len(t, jobs.Items, 1) {
+		newJob := jobs.Items[0]
+		assert.NotEqual(t, "migrate", newJob.Name)
+		assert.Equal(t, "migrate-", newJob.GenerateName)
+		assert.Equal(t, map[string]string{"app": "migrate"}, newJob.Labels)
+		assert.Nil(t, newJob.Spec.Selector)
+		assert.Equal(t, "ghcr.io/fairwinds/migrate:v1", newJob.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, "migrate", switches[0].OldJob)
+		assert.Equal(t, newJob.Name, switches[0].NewJob)
+	}
+
+	// a Job that does not use the old image is left in place
+	other := job.DeepCopy()
+	other.ResourceVersion = ""
+	other.Spec.Template.Spec.Containers[0].Image = "quay.io/fairwinds/other:v1"
+	r = newFakeReconciler(other)
+	assert.NoError(t, r.recreateJob(other.DeepCopy(), switches))
+	assert.NoError(t, r.List(context.Background(), jobs, client.InNamespace("default")))
+	if assert.Len(t, jobs.Items, 1) {
+		assert.Equal(t, "migrate", jobs.Items[0].Name)
+	}
+}
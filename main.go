@@ -17,17 +17,23 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"strings"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	"github.com/fairwindsops/controller-utils/pkg/controller"
 	saffirev1alpha1 "github.com/fairwindsops/saffire/api/v1alpha1"
 	"github.com/fairwindsops/saffire/controllers"
 	// +kubebuilder:scaffold:imports
@@ -49,14 +55,33 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var insecureRegistries string
+	var podTemplatePaths string
+	var argoCDNamespace string
+	var probeInterval time.Duration
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&insecureRegistries, "insecure-registries", "",
+		"Comma separated list of registry hosts that are reached over plain HTTP when verifying alternate images.")
+	flag.StringVar(&podTemplatePaths, "pod-template-paths", "",
+		"Comma separated list of Kind.group=path entries, such as Rollout.argoproj.io={.spec.template}, "+
+			"naming other workload kinds that can be switched and the path to their pod template.")
+	flag.StringVar(&argoCDNamespace, "argocd-namespace", "argocd",
+		"The namespace of the Argo CD Applications that do not name their own namespace in their tracking annotation.")
+	flag.DurationVar(&probeInterval, "registry-probe-interval", 0,
+		"How often the registries of every AlternateImageSource are probed, such as 1m. Registries are not probed when it is 0.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	templatePaths, err := controllers.ParsePodTemplatePaths(podTemplatePaths)
+	if err != nil {
+		setupLog.Error(err, "invalid pod template paths")
+		os.Exit(1)
+	}
+
 	cfg := ctrl.GetConfigOrDie()
 	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
 		Scheme:             scheme,
@@ -64,6 +89,9 @@ func main() {
 		Port:               9443,
 		LeaderElection:     enableLeaderElection,
 		LeaderElectionID:   "4dfa7ea8.fairwinds.com",
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{&corev1.Event{}: controllers.PodEventSelector},
+		}),
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -76,12 +104,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	dynamicClient := dynamic.NewForConfigOrDie(cfg)
 	if err = (&controllers.AlternateImageSourceReconciler{
 		Client:        mgr.GetClient(),
+		APIReader:     mgr.GetAPIReader(),
 		RestMapper:    mapper,
-		DynamicClient: dynamic.NewForConfigOrDie(cfg),
-		Log:           ctrl.Log.WithName("controllers").WithName("AlternateImageSource"),
-		Scheme:        mgr.GetScheme(),
+		DynamicClient: dynamicClient,
+		ControllerClient: controller.Client{
+			Context:    context.Background(),
+			Dynamic:    dynamicClient,
+			RESTMapper: mapper,
+		},
+		Log:              ctrl.Log.WithName("controllers").WithName("AlternateImageSource"),
+		Scheme:           mgr.GetScheme(),
+		PodTemplatePaths: templatePaths,
+		Registry:         controllers.NewRegistryClient(splitList(insecureRegistries)),
+		ArgoCDNamespace:  argoCDNamespace,
+		ProbeInterval:    probeInterval,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "AlternateImageSource")
 		os.Exit(1)
@@ -95,3 +134,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}